@@ -0,0 +1,443 @@
+// Parts of this file are adapted from cmd/cover, which is distributed under
+// the following license:
+//
+// Copyright 2009 The Go Authors.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are
+// met:
+//
+//    * Redistributions of source code must retain the above copyright
+// notice, this list of conditions and the following disclaimer.
+//    * Redistributions in binary form must reproduce the above
+// copyright notice, this list of conditions and the following disclaimer
+// in the documentation and/or other materials provided with the
+// distribution.
+//    * Neither the name of Google LLC nor the names of its
+// contributors may be used to endorse or promote products derived from
+// this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+// "AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+// LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+// A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+// OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+// SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+// LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+// THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+// (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"slices"
+)
+
+// blockFile instruments a file with one counter per basic block, rather than
+// one per statement, so that profiles line up with the ones produced by 'go
+// build -cover'.
+//
+// This follows cmd/cover's annotation closely (see the license above); where
+// the two differ, cmd/cover is right.
+type blockFile struct {
+	*file
+}
+
+func (f *blockFile) Visit(node ast.Node) ast.Visitor {
+	if f.err != nil {
+		return nil
+	}
+	switch n := node.(type) {
+	case *ast.BlockStmt:
+		// the body of a switch or select is a list of clauses, each of which
+		// is its own block.
+		if len(n.List) > 0 {
+			switch n.List[0].(type) {
+			case *ast.CaseClause:
+				for _, s := range n.List {
+					clause := s.(*ast.CaseClause)
+					f.addCounters(clause.Colon+1, clause.Colon+1, clause.End(), clause.Body, false)
+				}
+				return f
+			case *ast.CommClause:
+				for _, s := range n.List {
+					clause := s.(*ast.CommClause)
+					f.addCounters(clause.Colon+1, clause.Colon+1, clause.End(), clause.Body, false)
+				}
+				return f
+			}
+		}
+		f.addCounters(n.Lbrace, n.Lbrace+1, n.Rbrace+1, n.List, true)
+	case *ast.IfStmt:
+		if n.Init != nil {
+			ast.Walk(f, n.Init)
+		}
+		f.addCondCounters(n.Cond)
+		ast.Walk(f, n.Cond)
+		ast.Walk(f, n.Body)
+		if n.Else == nil {
+			return nil
+		}
+		// same as the statement visitor, we need somewhere to count an
+		// else-if, so wrap it in a block. unlike the statement visitor, the
+		// block starts right after "else", which is where cmd/cover starts
+		// counting it.
+		elseOffset := f.findText(n.Body.End(), "else")
+		if elseOffset < 0 {
+			f.err = fmt.Errorf("%s: couldn't find else", f.fset.Position(n.Body.End()))
+			return nil
+		}
+		f.buf.insert(elseOffset+4, "{")
+		f.insert(n.Else.End(), "}")
+
+		// count the else as if it were that block, without changing the
+		// syntax tree, which is still needed once we're done.
+		pos := f.fset.File(n.Body.End()).Pos(elseOffset + 4)
+		switch e := n.Else.(type) {
+		case *ast.IfStmt:
+			f.addCounters(pos, pos+1, e.End()+1, []ast.Stmt{e}, true)
+			ast.Walk(f, e)
+		case *ast.BlockStmt:
+			f.addCounters(pos, pos+1, e.Rbrace+1, e.List, true)
+			for _, s := range e.List {
+				ast.Walk(f, s)
+			}
+		}
+		return nil
+	case *ast.SelectStmt:
+		// an empty select can't hold a counter.
+		if n.Body == nil || len(n.Body.List) == 0 {
+			return nil
+		}
+	case *ast.ForStmt:
+		f.addCondCounters(n.Cond)
+	case *ast.SwitchStmt:
+		f.addSwitchCondCounters(n)
+		if n.Body == nil || len(n.Body.List) == 0 {
+			if n.Init != nil {
+				ast.Walk(f, n.Init)
+			}
+			if n.Tag != nil {
+				ast.Walk(f, n.Tag)
+			}
+			return nil
+		}
+	case *ast.TypeSwitchStmt:
+		if n.Body == nil || len(n.Body.List) == 0 {
+			if n.Init != nil {
+				ast.Walk(f, n.Init)
+			}
+			ast.Walk(f, n.Assign)
+			return nil
+		}
+	case *ast.FuncDecl:
+		// functions named _ can never run, and bodyless ones have nothing to
+		// count.
+		if n.Name.Name == "_" || n.Body == nil || f.nosplit(n) {
+			return nil
+		}
+	}
+	return f
+}
+
+// addCounters adds a counter to the start of each basic block in list, which
+// spans pos to blockEnd. The first counter goes at insertPos. Blocks nested in
+// the statements of list are counted when they're visited.
+func (f *blockFile) addCounters(pos, insertPos, blockEnd token.Pos, list []ast.Stmt, extendToClosingBrace bool) {
+	// an empty block still gets a counter, with no statements.
+	if len(list) == 0 {
+		r := f.codeRanges(insertPos, blockEnd)[0]
+		f.insert(r.pos, f.newCounter(r.pos, r.end, 0))
+		return
+	}
+
+	// we may need to split labeled statements, so don't touch the original.
+	list = slices.Clone(list)
+	for {
+		// the first statement which affects control flow is the last one in
+		// this block.
+		var last int
+		end := blockEnd
+		for last = 0; last < len(list); last++ {
+			stmt := list[last]
+			end = f.statementBoundary(stmt)
+			if !f.endsBasicSourceBlock(stmt) {
+				continue
+			}
+			// a label may be the target of a goto, so it starts a new block.
+			// given
+			//	foo: stmt
+			// we end up with
+			//	foo: counter(); stmt
+			// unless stmt is a loop or the like, which can't be separated
+			// from its label.
+			if label, ok := stmt.(*ast.LabeledStmt); ok && !isBreakTarget(label.Stmt) {
+				newLabel := *label
+				newLabel.Stmt = &ast.EmptyStmt{
+					Semicolon: label.Stmt.Pos(),
+					Implicit:  true,
+				}
+				end = label.Pos()
+				list[last] = &newLabel
+				list = slices.Insert(list, last+1, label.Stmt)
+			}
+			last++
+			extendToClosingBrace = false
+			break
+		}
+		if extendToClosingBrace {
+			end = blockEnd
+		}
+		// blocks can abut, leaving nothing to count.
+		if pos != end {
+			// each run of lines with code on them gets its own counter.
+			for i, r := range mergeRangesWithinStatements(f.codeRanges(pos, end), list[:last]) {
+				at := r.pos
+				if i == 0 {
+					at = insertPos
+				}
+				f.insert(at, f.newCounter(r.pos, r.end, last))
+			}
+		}
+		list = list[last:]
+		if len(list) == 0 {
+			break
+		}
+		pos = list[0].Pos()
+		insertPos = pos
+	}
+}
+
+// a contiguous range of code in a basic block.
+type codeRange struct {
+	pos, end token.Pos
+}
+
+// codeRanges splits the code between start and end into ranges of lines with
+// code on them, leaving out blank and comment-only lines. If there's no code,
+// it returns a single empty range at start.
+func (f *blockFile) codeRanges(start, end token.Pos) []codeRange {
+	startOffset := f.fset.Position(start).Offset
+	src := f.buf.orig[startOffset:f.fset.Position(end).Offset]
+	orig := f.fset.File(start)
+
+	// positions in scanned are relative to start.
+	scanned := token.NewFileSet().AddFile("", -1, len(src))
+	var s scanner.Scanner
+	s.Init(scanned, src, nil, 0)
+	toOrig := func(pos token.Pos) token.Pos {
+		return orig.Pos(startOffset + scanned.Offset(pos))
+	}
+
+	var (
+		ranges      []codeRange
+		codeStart   token.Pos
+		prevEndLine int // last line with code on it, or 0 before any code.
+	)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok == token.EOF {
+			break
+		}
+		// braces and automatic semicolons aren't code.
+		if tok == token.LBRACE || tok == token.RBRACE || (tok == token.SEMICOLON && lit == "\n") {
+			continue
+		}
+
+		startLine := scanned.PositionFor(pos, false).Line
+		endLine := startLine
+		if tok == token.STRING {
+			// raw strings can span lines.
+			endLine = scanned.PositionFor(pos+token.Pos(len(lit)), false).Line
+		}
+
+		if prevEndLine == 0 {
+			codeStart = toOrig(pos)
+		} else if startLine > prevEndLine+1 {
+			// there's a gap, so close the range at the start of the first
+			// line without code.
+			ranges = append(ranges, codeRange{codeStart, toOrig(scanned.LineStart(prevEndLine + 1))})
+			codeStart = toOrig(pos)
+		}
+		prevEndLine = max(prevEndLine, endLine)
+	}
+
+	if prevEndLine > 0 {
+		if prevEndLine < scanned.LineCount() {
+			ranges = append(ranges, codeRange{codeStart, toOrig(scanned.LineStart(prevEndLine + 1))})
+		} else {
+			ranges = append(ranges, codeRange{codeStart, end})
+		}
+	}
+
+	if len(ranges) == 0 {
+		return []codeRange{{start, start}}
+	}
+	return ranges
+}
+
+// mergeRangesWithinStatements merges ranges which start in the middle of a
+// statement (e.g. a blank line in a const block) into the range before them,
+// since there's no way to put a counter there.
+func mergeRangesWithinStatements(ranges []codeRange, stmts []ast.Stmt) []codeRange {
+	if len(ranges) <= 1 {
+		return ranges
+	}
+	merged := []codeRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		if insideStatement(r.pos, stmts) {
+			merged[len(merged)-1].end = r.end
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// reports whether pos is inside, but not at the start of, one of stmts.
+func insideStatement(pos token.Pos, stmts []ast.Stmt) bool {
+	i, _ := slices.BinarySearchFunc(stmts, pos, func(s ast.Stmt, p token.Pos) int {
+		return cmp.Compare(s.Pos(), p)
+	})
+	return i > 0 && pos < stmts[i-1].End()
+}
+
+// findText returns the offset of text in the source, starting from pos and
+// skipping comments, or -1 if it's not there.
+func (f *blockFile) findText(pos token.Pos, text string) int {
+	b := []byte(text)
+	s := f.buf.orig
+	i := f.fset.Position(pos).Offset
+	for i < len(s) {
+		if bytes.HasPrefix(s[i:], b) {
+			return i
+		}
+		if i+2 <= len(s) && s[i] == '/' && s[i+1] == '/' {
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			continue
+		}
+		if i+2 <= len(s) && s[i] == '/' && s[i+1] == '*' {
+			for i += 2; ; i++ {
+				if i+2 > len(s) {
+					return -1
+				}
+				if s[i] == '*' && s[i+1] == '/' {
+					i += 2
+					break
+				}
+			}
+			continue
+		}
+		i++
+	}
+	return -1
+}
+
+// statementBoundary returns where s ends its basic block: the start of the
+// body for control statements, or else the first function literal in it.
+func (f *blockFile) statementBoundary(s ast.Stmt) token.Pos {
+	switch s := s.(type) {
+	case *ast.BlockStmt:
+		return s.Lbrace
+	case *ast.IfStmt:
+		if found, pos := hasFuncLiteral(s.Init); found {
+			return pos
+		}
+		if found, pos := hasFuncLiteral(s.Cond); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	case *ast.ForStmt:
+		if found, pos := hasFuncLiteral(s.Init); found {
+			return pos
+		}
+		if found, pos := hasFuncLiteral(s.Cond); found {
+			return pos
+		}
+		if found, pos := hasFuncLiteral(s.Post); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	case *ast.LabeledStmt:
+		return f.statementBoundary(s.Stmt)
+	case *ast.RangeStmt:
+		if found, pos := hasFuncLiteral(s.X); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	case *ast.SwitchStmt:
+		if found, pos := hasFuncLiteral(s.Init); found {
+			return pos
+		}
+		if found, pos := hasFuncLiteral(s.Tag); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	case *ast.SelectStmt:
+		return s.Body.Lbrace
+	case *ast.TypeSwitchStmt:
+		if found, pos := hasFuncLiteral(s.Init); found {
+			return pos
+		}
+		return s.Body.Lbrace
+	}
+	if found, pos := hasFuncLiteral(s); found {
+		return pos
+	}
+	return s.End()
+}
+
+// endsBasicSourceBlock reports whether s changes the flow of control, or
+// contains a function literal, whose body is a block of its own.
+func (f *blockFile) endsBasicSourceBlock(s ast.Stmt) bool {
+	switch s := s.(type) {
+	case *ast.BlockStmt, *ast.BranchStmt, *ast.ForStmt, *ast.IfStmt,
+		*ast.LabeledStmt, *ast.RangeStmt, *ast.SwitchStmt,
+		*ast.SelectStmt, *ast.TypeSwitchStmt:
+		return true
+	case *ast.ExprStmt:
+		// without type checking we can't be sure this is the builtin panic,
+		// but it almost certainly is.
+		if call, ok := s.X.(*ast.CallExpr); ok {
+			if ident, ok := call.Fun.(*ast.Ident); ok && ident.Name == "panic" && len(call.Args) == 1 {
+				return true
+			}
+		}
+	}
+	found, _ := hasFuncLiteral(s)
+	return found
+}
+
+// hasFuncLiteral reports whether n contains a function literal, and the
+// position of the first one's body.
+func hasFuncLiteral(n ast.Node) (bool, token.Pos) {
+	if n == nil {
+		return false, token.NoPos
+	}
+	var lit funcLitFinder
+	ast.Walk(&lit, n)
+	return lit != 0, token.Pos(lit)
+}
+
+type funcLitFinder token.Pos
+
+func (f *funcLitFinder) Visit(node ast.Node) ast.Visitor {
+	if *f != 0 {
+		return nil
+	}
+	if lit, ok := node.(*ast.FuncLit); ok {
+		*f = funcLitFinder(lit.Body.Lbrace)
+		return nil
+	}
+	return f
+}
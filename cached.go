@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// what we recorded about a file when compiling it, for reports.
+type cachedFile struct {
+	source string // the path to its source
+	funcs  []cachedFunc
+}
+
+// a function's extent in a file, by its name in covdata.
+type cachedFunc struct {
+	name                                 string
+	startLine, startCol, endLine, endCol int
+	bodyLine, bodyCol                    int // where the code in its body starts
+}
+
+// contains reports whether the block at pos is in the function.
+func (fn cachedFunc) contains(startLine, startCol, endLine, endCol int) bool {
+	afterStart := startLine > fn.startLine || (startLine == fn.startLine && startCol >= fn.startCol)
+	beforeEnd := endLine < fn.endLine || (endLine == fn.endLine && endCol <= fn.endCol)
+	return afterStart && beforeEnd
+}
+
+// cachedFiles returns what we recorded about each file we've instrumented, by
+// its name in profiles. if a file was built more than once, the most recent
+// build wins.
+func cachedFiles() (map[string]*cachedFile, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// read oldest first, so newer builds replace older ones.
+	type cacheFile struct {
+		path    string
+		modTime int64
+	}
+	var caches []cacheFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		caches = append(caches, cacheFile{filepath.Join(dir, e.Name()), info.ModTime().UnixNano()})
+	}
+	slices.SortFunc(caches, func(a, b cacheFile) int {
+		return cmp.Compare(a.modTime, b.modTime)
+	})
+
+	files := make(map[string]*cachedFile)
+	for _, c := range caches {
+		if err := readCachedFiles(c.path, files); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func readCachedFiles(path string, files map[string]*cachedFile) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fresh := make(map[string]*cachedFile) // the files in this build
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "--" {
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		kind := fields[3]
+		if kind != sourceExtent && kind != declExtent && kind != litExtent {
+			continue
+		}
+		name, sl, sc, el, ec, err := parseBlockPos(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s: invalid cache line: %q", path, line)
+		}
+		cf, ok := fresh[name]
+		if !ok {
+			cf = new(cachedFile)
+			fresh[name] = cf
+			files[name] = cf
+		}
+		if kind != sourceExtent {
+			if len(fields) != 6 {
+				return fmt.Errorf("%s: invalid cache line: %q", path, line)
+			}
+			bodyLine, bodyCol, _ := strings.Cut(fields[5], ".")
+			bl, lerr := strconv.Atoi(bodyLine)
+			bc, cerr := strconv.Atoi(bodyCol)
+			if lerr != nil || cerr != nil {
+				return fmt.Errorf("%s: invalid cache line: %q", path, line)
+			}
+			cf.funcs = append(cf.funcs, cachedFunc{fields[4], sl, sc, el, ec, bl, bc})
+			continue
+		}
+		_, quoted, _ := strings.Cut(line, " "+sourceExtent+" ")
+		if cf.source, err = strconv.Unquote(quoted); err != nil {
+			return fmt.Errorf("%s: invalid cache line: %q", path, line)
+		}
+	}
+	return scanner.Err()
+}
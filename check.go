@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// check fails when the coverage of the program, or of any of the packages or
+// files given thresholds, is below them.
+func check(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	config := fs.String("config", "", "read thresholds from `file`")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cover check -config file profile")
+		fmt.Fprintln(fs.Output(), `
+Each line of the config is a target and the least percentage of its statements
+which must be covered:
+
+	*                       80    everything in the profile
+	example.com/pkg         70    a package
+	example.com/pkg/file.go 90    a file
+
+Blank lines and those starting with # are ignored.`)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || *config == "" {
+		fs.Usage()
+		return 2
+	}
+
+	thresholds, err := readThresholds(*config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	p, err := readProfile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	offenders, err := checkThresholds(p, thresholds)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if len(offenders) == 0 {
+		return 0
+	}
+	writeOffenders(os.Stdout, offenders)
+	return 1
+}
+
+// the least coverage allowed for a target: "*" for everything, a package's
+// import path, or a file as named in profiles.
+type threshold struct {
+	target  string
+	percent float64
+	line    string // where it was set, for errors
+}
+
+func readThresholds(path string) ([]threshold, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseThresholds(f, path)
+}
+
+func parseThresholds(r io.Reader, name string) ([]threshold, error) {
+	var thresholds []threshold
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a target and a percentage, got %q", name, n, line)
+		}
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(fields[1], "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("%s:%d: invalid percentage %q", name, n, fields[1])
+		}
+		thresholds = append(thresholds, threshold{fields[0], percent, fmt.Sprintf("%s:%d", name, n)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return thresholds, nil
+}
+
+// a target whose coverage is below its threshold.
+type offender struct {
+	target             string
+	covered, total     int
+	percent, threshold float64
+}
+
+// checkThresholds returns the targets whose coverage is below their
+// thresholds, in the order the thresholds were given.
+func checkThresholds(p *profile, thresholds []threshold) ([]offender, error) {
+	// statements covered and in total, by target.
+	type stmts struct{ covered, total int }
+	counts := make(map[string]*stmts)
+	add := func(target string, b profileBlock) {
+		s := counts[target]
+		if s == nil {
+			s = new(stmts)
+			counts[target] = s
+		}
+		s.total += b.numStmt
+		if b.count > 0 {
+			s.covered += b.numStmt
+		}
+	}
+	for _, b := range p.blocks {
+		file, _, _, _, _, err := parseBlockPos(b.pos)
+		if err != nil {
+			return nil, err
+		}
+		add("*", b)
+		add(path.Dir(file), b)
+		add(file, b)
+	}
+
+	var offenders []offender
+	for _, t := range thresholds {
+		s := counts[t.target]
+		if s == nil {
+			return nil, fmt.Errorf("%s: no coverage of %s in profile", t.line, t.target)
+		}
+		percent := 0.0
+		if s.total > 0 {
+			percent = 100 * float64(s.covered) / float64(s.total)
+		}
+		if percent < t.percent {
+			offenders = append(offenders, offender{t.target, s.covered, s.total, percent, t.percent})
+		}
+	}
+	return offenders, nil
+}
+
+func writeOffenders(w io.Writer, offenders []offender) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "target\tcoverage\tthreshold\tstatements")
+	for _, o := range offenders {
+		target := o.target
+		if target == "*" {
+			target = "total"
+		}
+		fmt.Fprintf(tw, "%s\t%.1f%%\t%.1f%%\t%d/%d\n", target, o.percent, o.threshold, o.covered, o.total)
+	}
+	tw.Flush()
+}
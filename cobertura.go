@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cobertura converts a profile to Cobertura XML, for CI dashboards. branch
+// rates come from the branch profile next to it, if there is one.
+func cobertura(args []string) int {
+	fs := flag.NewFlagSet("cobertura", flag.ContinueOnError)
+	out := fs.String("o", "", "write the report to `file` instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cover cobertura [-o file] profile")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	p, err := readProfile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	branches, err := readBranchProfile(companionPath(fs.Arg(0), "branch"))
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cached, err := cachedFiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cov, err := coberturaReport(p, branches, cached, wd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cov.Timestamp = time.Now().UnixMilli()
+
+	if err := withOutput(*out, cov.write); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// see https://cobertura.github.io/cobertura/xml/coverage-04.dtd
+type coberturaCoverage struct {
+	XMLName         xml.Name           `xml:"coverage"`
+	LineRate        float64            `xml:"line-rate,attr"`
+	BranchRate      float64            `xml:"branch-rate,attr"`
+	LinesCovered    int                `xml:"lines-covered,attr"`
+	LinesValid      int                `xml:"lines-valid,attr"`
+	BranchesCovered int                `xml:"branches-covered,attr"`
+	BranchesValid   int                `xml:"branches-valid,attr"`
+	Complexity      float64            `xml:"complexity,attr"`
+	Version         string             `xml:"version,attr"`
+	Timestamp       int64              `xml:"timestamp,attr"`
+	Sources         []string           `xml:"sources>source"`
+	Packages        []coberturaPackage `xml:"packages>package"`
+}
+
+type coberturaPackage struct {
+	Name       string           `xml:"name,attr"`
+	LineRate   float64          `xml:"line-rate,attr"`
+	BranchRate float64          `xml:"branch-rate,attr"`
+	Complexity float64          `xml:"complexity,attr"`
+	Classes    []coberturaClass `xml:"classes>class"`
+}
+
+// go has no classes, so each file is one.
+type coberturaClass struct {
+	Name       string            `xml:"name,attr"`
+	Filename   string            `xml:"filename,attr"`
+	LineRate   float64           `xml:"line-rate,attr"`
+	BranchRate float64           `xml:"branch-rate,attr"`
+	Complexity float64           `xml:"complexity,attr"`
+	Methods    []coberturaMethod `xml:"methods>method"`
+	Lines      []coberturaLine   `xml:"lines>line"`
+}
+
+type coberturaMethod struct {
+	Name       string          `xml:"name,attr"`
+	Signature  string          `xml:"signature,attr"`
+	LineRate   float64         `xml:"line-rate,attr"`
+	BranchRate float64         `xml:"branch-rate,attr"`
+	Complexity float64         `xml:"complexity,attr"`
+	Lines      []coberturaLine `xml:"lines>line"`
+}
+
+type coberturaLine struct {
+	Number            int    `xml:"number,attr"`
+	Hits              uint64 `xml:"hits,attr"`
+	Branch            bool   `xml:"branch,attr"`
+	ConditionCoverage string `xml:"condition-coverage,attr,omitempty"`
+
+	branches, branchesCovered int
+}
+
+func (c *coberturaCoverage) write(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">` + "\n")
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "\t")
+	if err := enc.Encode(c); err != nil {
+		return err
+	}
+	buf.WriteString("\n")
+	return buf.Flush()
+}
+
+// a branch, as in branch profiles.
+type branchCount struct {
+	pos                   string
+	trueCount, falseCount uint64
+}
+
+func readBranchProfile(path string) ([]branchCount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var branches []branchCount
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if n == 1 || line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: invalid branch: %q", path, n, line)
+		}
+		t, terr := strconv.ParseUint(fields[1], 10, 64)
+		ff, ferr := strconv.ParseUint(fields[2], 10, 64)
+		if terr != nil || ferr != nil {
+			return nil, fmt.Errorf("%s:%d: invalid branch: %q", path, n, line)
+		}
+		branches = append(branches, branchCount{fields[0], t, ff})
+	}
+	return branches, scanner.Err()
+}
+
+// coberturaReport groups the blocks in p by package and file. files are named
+// relative to wd, where their sources are under it.
+func coberturaReport(p *profile, branches []branchCount, cached map[string]*cachedFile, wd string) (*coberturaCoverage, error) {
+	// the lines of each file, then the branches on each.
+	lines := make(map[string]map[int]*coberturaLine)
+	line := func(file string, n int) *coberturaLine {
+		if lines[file] == nil {
+			lines[file] = make(map[int]*coberturaLine)
+		}
+		l := lines[file][n]
+		if l == nil {
+			l = &coberturaLine{Number: n}
+			lines[file][n] = l
+		}
+		return l
+	}
+	counts, err := p.lineCounts()
+	if err != nil {
+		return nil, err
+	}
+	for file, fl := range counts {
+		for n, count := range fl {
+			line(file, n).Hits = count
+		}
+	}
+	for _, b := range branches {
+		file, sl, _, _, _, err := parseBlockPos(b.pos)
+		if err != nil {
+			return nil, err
+		}
+		if lines[file] == nil {
+			continue
+		}
+		// if there's no block on the condition's line, it ran as often as
+		// the condition did.
+		l, ok := lines[file][sl]
+		if !ok {
+			l = line(file, sl)
+			l.Hits = b.trueCount + b.falseCount
+		}
+		l.Branch = true
+		l.branches += 2
+		if b.trueCount > 0 {
+			l.branchesCovered++
+		}
+		if b.falseCount > 0 {
+			l.branchesCovered++
+		}
+		l.ConditionCoverage = fmt.Sprintf("%d%% (%d/%d)", 100*l.branchesCovered/l.branches, l.branchesCovered, l.branches)
+	}
+
+	cov := &coberturaCoverage{
+		Version: "ehden.net/cover",
+		Sources: []string{wd},
+	}
+	byPkg := make(map[string][]string)
+	for file := range lines {
+		pkg := path.Dir(file)
+		byPkg[pkg] = append(byPkg[pkg], file)
+	}
+	pkgs := make([]string, 0, len(byPkg))
+	for pkg := range byPkg {
+		pkgs = append(pkgs, pkg)
+	}
+	slices.Sort(pkgs)
+
+	var all coberturaRates
+	for _, pkg := range pkgs {
+		files := byPkg[pkg]
+		slices.Sort(files)
+		var pkgRates coberturaRates
+		cp := coberturaPackage{Name: pkg}
+		for _, file := range files {
+			nums := make([]int, 0, len(lines[file]))
+			for n := range lines[file] {
+				nums = append(nums, n)
+			}
+			slices.Sort(nums)
+			class := coberturaClass{Name: file, Filename: file}
+			var rates coberturaRates
+			for _, n := range nums {
+				l := lines[file][n]
+				class.Lines = append(class.Lines, *l)
+				rates.add(l)
+			}
+			if cf := cached[file]; cf != nil {
+				if rel, err := filepath.Rel(wd, cf.source); cf.source != "" && err == nil && filepath.IsLocal(rel) {
+					class.Filename = filepath.ToSlash(rel)
+				}
+				for _, fn := range cf.funcs {
+					m := coberturaMethod{Name: fn.name}
+					var mr coberturaRates
+					for _, n := range nums {
+						if n >= fn.startLine && n <= fn.endLine {
+							l := lines[file][n]
+							m.Lines = append(m.Lines, *l)
+							mr.add(l)
+						}
+					}
+					m.LineRate, m.BranchRate = mr.rates()
+					class.Methods = append(class.Methods, m)
+				}
+			}
+			class.LineRate, class.BranchRate = rates.rates()
+			cp.Classes = append(cp.Classes, class)
+			pkgRates.addAll(rates)
+		}
+		cp.LineRate, cp.BranchRate = pkgRates.rates()
+		cov.Packages = append(cov.Packages, cp)
+		all.addAll(pkgRates)
+	}
+	cov.LineRate, cov.BranchRate = all.rates()
+	cov.LinesCovered, cov.LinesValid = all.linesCovered, all.lines
+	cov.BranchesCovered, cov.BranchesValid = all.branchesCovered, all.branches
+	return cov, nil
+}
+
+type coberturaRates struct {
+	lines, linesCovered       int
+	branches, branchesCovered int
+}
+
+func (r *coberturaRates) add(l *coberturaLine) {
+	r.lines++
+	if l.Hits > 0 {
+		r.linesCovered++
+	}
+	r.branches += l.branches
+	r.branchesCovered += l.branchesCovered
+}
+
+func (r *coberturaRates) addAll(o coberturaRates) {
+	r.lines += o.lines
+	r.linesCovered += o.linesCovered
+	r.branches += o.branches
+	r.branchesCovered += o.branchesCovered
+}
+
+// rates returns the line and branch rates, as fractions. like gcovr and
+// coverage.py, code without branches has all of them covered, rather than none.
+func (r coberturaRates) rates() (line, branch float64) {
+	if r.lines > 0 {
+		line = float64(r.linesCovered) / float64(r.lines)
+	}
+	branch = 1
+	if r.branches > 0 {
+		branch = float64(r.branchesCovered) / float64(r.branches)
+	}
+	return line, branch
+}
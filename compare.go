@@ -0,0 +1,206 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+// compare reports how coverage changed between two profiles, e.g. of two test
+// runs or two releases.
+func compare(args []string) int {
+	fs := flag.NewFlagSet("compare", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cover compare old-profile new-profile")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	before, err := readProfile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	after, err := readProfile(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c, err := compareProfiles(before, after)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	c.write(os.Stdout)
+	return 0
+}
+
+// the differences between two profiles. blocks are matched by their
+// positions, so only count as the same block if the code around them didn't
+// move.
+type comparison struct {
+	newlyCovered, newlyUncovered []string
+	added, removed               []profileBlock
+
+	pkgs []pkgDelta
+}
+
+// a package's coverage, in each profile.
+type pkgDelta struct {
+	pkg           string
+	before, after coverage
+}
+
+// statements covered and in total.
+type coverage struct {
+	covered, total int
+}
+
+func (c *coverage) add(b profileBlock) {
+	c.total += b.numStmt
+	if b.count > 0 {
+		c.covered += b.numStmt
+	}
+}
+
+func (c coverage) percent() float64 {
+	if c.total == 0 {
+		return 0
+	}
+	return 100 * float64(c.covered) / float64(c.total)
+}
+
+// compareProfiles compares profiles of the same mode. readProfile has already
+// combined any blocks they repeat, so each is only counted once.
+func compareProfiles(before, after *profile) (*comparison, error) {
+	if before.mode != after.mode {
+		return nil, fmt.Errorf("%s: mode %q doesn't match %q in %s", after.path, after.mode, before.mode, before.path)
+	}
+	c := new(comparison)
+	beforeBlocks := make(map[string]profileBlock)
+	for _, b := range before.blocks {
+		beforeBlocks[b.pos] = b
+	}
+	afterBlocks := make(map[string]profileBlock)
+	for _, b := range after.blocks {
+		afterBlocks[b.pos] = b
+	}
+
+	pkgs := make(map[string]*pkgDelta)
+	pkg := func(pos string) (*pkgDelta, error) {
+		file, _, _, _, _, err := parseBlockPos(pos)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Dir(file)
+		d := pkgs[name]
+		if d == nil {
+			d = &pkgDelta{pkg: name}
+			pkgs[name] = d
+		}
+		return d, nil
+	}
+
+	for _, b := range before.blocks {
+		d, err := pkg(b.pos)
+		if err != nil {
+			return nil, err
+		}
+		d.before.add(b)
+		ab, ok := afterBlocks[b.pos]
+		switch {
+		case !ok:
+			c.removed = append(c.removed, b)
+		case b.count == 0 && ab.count > 0:
+			c.newlyCovered = append(c.newlyCovered, b.pos)
+		case b.count > 0 && ab.count == 0:
+			c.newlyUncovered = append(c.newlyUncovered, b.pos)
+		}
+	}
+	for _, b := range after.blocks {
+		d, err := pkg(b.pos)
+		if err != nil {
+			return nil, err
+		}
+		d.after.add(b)
+		if _, ok := beforeBlocks[b.pos]; !ok {
+			c.added = append(c.added, b)
+		}
+	}
+
+	for _, d := range pkgs {
+		c.pkgs = append(c.pkgs, *d)
+	}
+	slices.SortFunc(c.pkgs, func(a, b pkgDelta) int {
+		return strings.Compare(a.pkg, b.pkg)
+	})
+	return c, nil
+}
+
+func (c *comparison) write(w io.Writer) {
+	section := func(title string, blocks []string) {
+		if len(blocks) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "%s (%d):\n", title, len(blocks))
+		for _, b := range blocks {
+			fmt.Fprintf(w, "\t%s\n", b)
+		}
+		fmt.Fprintln(w)
+	}
+	withCoverage := func(blocks []profileBlock) []string {
+		s := make([]string, len(blocks))
+		for i, b := range blocks {
+			if b.count > 0 {
+				s[i] = b.pos + " covered"
+			} else {
+				s[i] = b.pos + " not covered"
+			}
+		}
+		return s
+	}
+	section("newly uncovered", c.newlyUncovered)
+	section("newly covered", c.newlyCovered)
+	section("added", withCoverage(c.added))
+	section("removed", withCoverage(c.removed))
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "package\told\tnew\tdelta")
+	var before, after coverage
+	row := func(name string, b, a coverage) {
+		delta := "-"
+		if b.total > 0 && a.total > 0 {
+			delta = fmt.Sprintf("%+.1f%%", a.percent()-b.percent())
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, percentOf(b), percentOf(a), delta)
+	}
+	for _, d := range c.pkgs {
+		row(d.pkg, d.before, d.after)
+		before.covered += d.before.covered
+		before.total += d.before.total
+		after.covered += d.after.covered
+		after.total += d.after.total
+	}
+	row("total", before, after)
+	tw.Flush()
+}
+
+// percentOf formats coverage as a percentage, or "-" if there's nothing to
+// cover, e.g. for a package only in one profile.
+func percentOf(c coverage) string {
+	if c.total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", c.percent())
+}
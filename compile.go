@@ -12,10 +12,11 @@ import (
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 )
 
-func compile(coverPaths []string, tool string, args []string) ([]string, error) {
+func compile(conf config, tool string, args []string) ([]string, error) {
 	importPath := os.Getenv("TOOLEXEC_IMPORTPATH")
 	_, buildid := getFlag(args, "buildid")
 	_, pkg := getFlag(args, "p")
@@ -25,14 +26,16 @@ func compile(coverPaths []string, tool string, args []string) ([]string, error)
 	actionID, _, _ := strings.Cut(buildid, "/")
 
 	if linkPath := os.Getenv(coverImportcfg); linkPath != "" {
-		return fixImportCfg(args, linkPath, workDir)
+		return fixImportCfg(args, pkg, linkPath, workDir)
 	}
 
-	instrument := slices.Contains(coverPaths, "*") || slices.Contains(coverPaths, importPath)
-	instrument = instrument || (len(coverPaths) == 0 && pkg == "main")
-	// we need to our "exit hook" to main, even if we're not meant to
-	// instrument it for coverage
-	if !instrument && pkg != "main" {
+	instrument := slices.Contains(conf.pkgs, "*") || slices.Contains(conf.pkgs, importPath)
+	instrument = instrument || (len(conf.pkgs) == 0 && pkg == "main")
+	// we need to remember how main was compiled, to recompile it with the
+	// cover vars when linking, and to hook the runtime's exits, even if we're
+	// not meant to instrument either for coverage. os/signal is patched so we
+	// can tell which signals the program handles; see signalRefsDecl.
+	if !instrument && pkg != "main" && pkg != "runtime" && pkg != "os/signal" {
 		return args, nil
 	}
 
@@ -46,13 +49,18 @@ func compile(coverPaths []string, tool string, args []string) ([]string, error)
 	}
 
 	cacheFilePath := filepath.Join(cacheDir, actionID)
-	if err := os.MkdirAll(cacheDir, 0777); err != nil {
+	// builds sharing a cache can compile the same package at once, so the entry
+	// is written elsewhere and renamed into place, for nobody to see it
+	// half-written. the tmp dir keeps it away from cachedFiles until then.
+	tmpDir := filepath.Join(cacheDir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0777); err != nil {
 		return args, err
 	}
-	cacheFile, err := os.Create(cacheFilePath)
+	cacheFile, err := os.CreateTemp(tmpDir, actionID+"-*")
 	if err != nil {
 		return args, err
 	}
+	defer os.Remove(cacheFile.Name())
 	defer cacheFile.Close()
 	cache := bufio.NewWriter(cacheFile)
 
@@ -81,30 +89,62 @@ func compile(coverPaths []string, tool string, args []string) ([]string, error)
 
 	_, files := goFiles(args)
 	fset := token.NewFileSet()
+	// every file is parsed first, since whether a name is a constant can
+	// depend on the others; see isConst.
+	sources := make([][]byte, len(files))
+	syntax := make([]*ast.File, len(files))
 	for i, path := range files {
 		contents, err := os.ReadFile(path)
 		if err != nil {
 			return nil, err
 		}
-
 		parsed, err := parser.ParseFile(fset, path, contents, parser.ParseComments)
 		if err != nil {
 			return nil, err
 		}
-
+		sources[i], syntax[i] = contents, parsed
+	}
+	consts := pkgConsts(syntax)
+
+	std := slices.Contains(args, "-std")
+	// much of the runtime can't have write barriers, which calling the cover
+	// vars with the conditions' values can bring in, so it only gets counters
+	// for statements.
+	condCounters := !(std && isRuntimePkg(pkg))
+	found := make(map[string]bool)
+	for i, path := range files {
 		f := &file{
-			buf:        newBuffer(contents),
+			buf:        newBuffer(sources[i]),
 			fset:       fset,
 			importPath: importPath,
-			syntax:     parsed,
+			syntax:     syntax[i],
+			consts:     consts,
+			branch:     conf.branch && condCounters,
+			conditions: conf.conditions && condCounters,
+			std:        std,
 		}
 
 		if instrument {
-			ast.Walk(f, parsed)
+			var v ast.Visitor = f
+			switch conf.granularity {
+			case "block":
+				v = &blockFile{f}
+			case "func":
+				v = &funcFile{file: f, lits: new(int)}
+			}
+			ast.Walk(v, syntax[i])
+			if f.err != nil {
+				return nil, f.err
+			}
 		}
 
-		if pkg == "main" {
+		switch pkg {
+		case "main":
 			f.addMainInit()
+		case "runtime":
+			f.addExitHooks(found)
+		case "os/signal":
+			f.findSignalRefs(found)
 		}
 
 		for _, b := range f.blocks {
@@ -113,7 +153,17 @@ func compile(coverPaths []string, tool string, args []string) ([]string, error)
 
 			cv := b.coverVar()
 			fmt.Fprintf(covervars, "//go:linkname %s %s.%s_%s\n", cv, coverPkgPath, cv, cleanIDPart(actionID))
-			fmt.Fprintf(covervars, "func %s() // %s\n\n", cv, ce)
+			fmt.Fprintf(covervars, "func %s%s // %s\n\n", cv, b.signature(), ce)
+		}
+		if instrument {
+			for _, e := range f.funcExtents() {
+				fmt.Fprintln(cache, e.cacheEntry())
+			}
+			src, err := f.sourceExtent(path)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Fprintln(cache, src.cacheEntry())
 		}
 
 		new := f.buf.bytes()
@@ -130,9 +180,38 @@ func compile(coverPaths []string, tool string, args []string) ([]string, error)
 		files[i] = outPath
 	}
 
+	if pkg == "runtime" {
+		// these are the runtime's internals, which a new go release could
+		// rename. that shouldn't break builds, so programs just won't write
+		// coverage when exiting that way, only when main returns (see
+		// addMainInit); the hook itself is still declared for the cover vars
+		// package to set.
+		for _, name := range runtimeHooked {
+			if !found[name] {
+				fmt.Fprintf(os.Stderr, "cover: couldn't find runtime.%s to hook; coverage won't be written on os.Exit or panics\n", name)
+			}
+		}
+		fmt.Fprint(covervars, exitHookDecl)
+		fmt.Fprint(covervars, signalRefsDecl)
+	}
+	if pkg == "os/signal" {
+		// likewise, without them, signals are treated as unhandled.
+		var missing []string
+		for _, name := range signalRefsUses {
+			if !found[name] {
+				missing = append(missing, name)
+			}
+		}
+		if len(missing) == 0 {
+			fmt.Fprint(covervars, signalRefsFunc)
+		} else {
+			fmt.Fprintf(os.Stderr, "cover: couldn't find os/signal's %s; signals will be treated as unhandled\n", strings.Join(missing, ", "))
+		}
+	}
+
 	if pkg == "main" {
 		fmt.Fprintf(covervars, "//go:linkname _WriteCoverage %s.WriteCoverage\n", coverPkgPath)
-		fmt.Fprint(covervars, "func _WriteCoverage()\n")
+		fmt.Fprint(covervars, "func _WriteCoverage()\n\n")
 
 		cfgPath = strings.Replace(cfgPath, workDir, filepath.Dir(coverFilePath), 1)
 		args[cfgPathIDx] = cfgPath
@@ -148,7 +227,15 @@ func compile(coverPaths []string, tool string, args []string) ([]string, error)
 	}
 	cache.WriteRune('\n')
 
-	cache.Flush()
+	if err := cache.Flush(); err != nil {
+		return nil, err
+	}
+	if err := cacheFile.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(cacheFile.Name(), cacheFilePath); err != nil {
+		return nil, err
+	}
 	covervars.Flush()
 
 	return args, nil
@@ -167,12 +254,74 @@ func coverPkgs() []string {
 	return pkgs
 }
 
-func fixImportCfg(args []string, linkPath, workDir string) ([]string, error) {
+// coverMode returns the coverage mode set in the environment, which determines
+// how the generated cover vars record each block being hit:
+//
+//   - set: whether the block ran at all (the default)
+//   - count: how many times the block ran
+//   - atomic: like count, but safe to use from many goroutines at once
+func coverMode() (string, error) {
+	mode := strings.TrimSpace(os.Getenv(coverModeVar))
+	switch mode {
+	case "":
+		return "set", nil
+	case "set", "count", "atomic":
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid %s %q: must be one of set, count, atomic", coverModeVar, mode)
+}
+
+// coverGranularity returns the granularity set in the environment, which
+// determines how much code each counter covers:
+//
+//   - stmt: one counter per statement (the default)
+//   - block: one counter per basic block, like cmd/cover
+//   - func: one counter per function, at the top of its body
+func coverGranularity() (string, error) {
+	granularity := strings.TrimSpace(os.Getenv(coverGranularityVar))
+	switch granularity {
+	case "":
+		return "stmt", nil
+	case "stmt", "block", "func":
+		return granularity, nil
+	}
+	return "", fmt.Errorf("invalid %s %q: must be one of stmt, block, func", coverGranularityVar, granularity)
+}
+
+// boolVar reads an on/off setting from the environment, where unset means off.
+func boolVar(name string) (bool, error) {
+	v := strings.TrimSpace(os.Getenv(name))
+	if v == "" {
+		return false, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", name, v, err)
+	}
+	return on, nil
+}
+
+func fixImportCfg(args []string, pkg, linkPath, workDir string) ([]string, error) {
 	linkCfg, err := readImportCfg(linkPath)
 	if err != nil {
 		return args, fmt.Errorf("couldn't read linker importcfg: %w", err)
 	}
 
+	// the packages which import this one are compiled against the linker's
+	// copy of it (see below), and the vars package is linked with that, so
+	// rather than compile another we hand over the linker's. the go command
+	// adds assembly to the archive after compiling it, so those packages are
+	// compiled anyway.
+	if file, ok := linkCfg.pkg[pkg]; ok {
+		if idx, _ := getFlag(args, "asmhdr"); idx == -1 {
+			_, out := getFlag(args, "o")
+			if err := copyFile(out, file); err != nil {
+				return args, err
+			}
+			return args, errJustExit(0)
+		}
+	}
+
 	idx, cfgPath := getFlag(args, "importcfg")
 	cfg, err := readImportCfg(cfgPath)
 	if err != nil {
@@ -200,29 +349,101 @@ func fixImportCfg(args []string, linkPath, workDir string) ([]string, error) {
 	return args, nil
 }
 
+// kinds of blocks. plain blocks count code running.
+const (
+	plainBlock  = ""
+	branchBlock = "branch" // a condition, counted when true and when false
+	condBlock   = "cond"   // an operand of && or ||, counted like a branch
+	funcBlock   = "func"   // a function's body, counted like a plain block
+
+	// not counted, but recorded so that blocks can be grouped by function.
+	declExtent = "decl" // a function declaration
+	litExtent  = "lit"  // a function literal outside of any declaration
+
+	// a whole file, recorded along with where its source is, for reports.
+	sourceExtent = "source"
+)
+
 type block struct {
-	file string // importPath:file.go
+	file    string // importPath:file.go
+	kind    string
+	numStmt int
+	name    string // for functions, or the path to a file's source
+
+	// for conditions, whether the operand's value is the value of the whole
+	// expression, when it's true and when it's false.
+	decidesTrue, decidesFalse bool
 
 	start               token.Pos
 	startLine, startCol int
 
 	end             token.Pos
 	endLine, endCol int
+
+	// for function extents, where the code in the body starts.
+	bodyLine, bodyCol int
 }
 
 func (b block) coverVar() string {
 	return fmt.Sprintf(
-		"cover_%d_%d",
-		b.start, b.end,
+		"%s_%d_%d",
+		coverVarPrefix(b.kind), b.start, b.end,
 	)
 }
 
+// returns the prefix of the cover vars for blocks of kind.
+func coverVarPrefix(kind string) string {
+	switch kind {
+	case branchBlock:
+		return "coverbr"
+	case condBlock:
+		return "covercond"
+	}
+	return "cover"
+}
+
+// returns the signature of the cover var's func, minus the name.
+func (b block) signature() string {
+	if b.kind == branchBlock || b.kind == condBlock {
+		return "(bool) bool"
+	}
+	return "()"
+}
+
 func (b block) cacheEntry() string {
-	return fmt.Sprintf(
-		"%s:%d.%d,%d.%d %d_%d",
+	ce := fmt.Sprintf(
+		"%s:%d.%d,%d.%d %d %d_%d",
 		b.file, b.startLine, b.startCol, b.endLine, b.endCol,
-		b.start, b.end,
+		b.numStmt, b.start, b.end,
 	)
+	if b.kind != plainBlock {
+		ce += " " + b.kind
+	}
+	switch b.kind {
+	case condBlock:
+		ce += " " + decidesFlags(b.decidesTrue, b.decidesFalse)
+	case funcBlock:
+		ce += " " + b.name
+	case declExtent, litExtent:
+		ce += fmt.Sprintf(" %s %d.%d", b.name, b.bodyLine, b.bodyCol)
+	case sourceExtent:
+		// paths can have spaces, so this is always last.
+		ce += " " + strconv.Quote(b.name)
+	}
+	return ce
+}
+
+// encodes when a condition decides its expression's value, as "tf", "t-", "-f"
+// or "--".
+func decidesFlags(decidesTrue, decidesFalse bool) string {
+	flags := []byte("--")
+	if decidesTrue {
+		flags[0] = 't'
+	}
+	if decidesFalse {
+		flags[1] = 'f'
+	}
+	return string(flags)
 }
 
 type file struct {
@@ -230,15 +451,35 @@ type file struct {
 	fset       *token.FileSet
 	importPath string
 	syntax     *ast.File
+	branch     bool // whether to add branch counters
+	conditions bool // whether to add counters to operands of && and ||
+	std        bool // whether it's in the standard library
+	// the names declared at the top level of the package, and whether each
+	// is a constant.
+	consts map[string]bool
 
 	blocks []block
+	err    error // the first error instrumenting the file, if any
+
+	// loops enclosing the node being visited, innermost last.
+	loops []*loop
+	// labels of the labeled statements seen so far.
+	labels map[ast.Stmt]*ast.LabeledStmt
 }
 
-func (f *file) newBlock(pos, end token.Pos) block {
+// a loop being instrumented, so that continue statements can count the loop's
+// post statement.
+type loop struct {
+	label string // "" for unlabeled loops
+	post  string // counter for the post statement, if any
+}
+
+func (f *file) newBlock(pos, end token.Pos, numStmt int) block {
 	pPos := f.fset.Position(pos)
 	ePos := f.fset.Position(end)
 	return block{
-		file: fmt.Sprintf("%s/%s", f.importPath, filepath.Base(pPos.Filename)),
+		file:    fmt.Sprintf("%s/%s", f.importPath, filepath.Base(pPos.Filename)),
+		numStmt: numStmt,
 
 		start:     pos,
 		startLine: pPos.Line,
@@ -256,12 +497,88 @@ func (f *file) insert(pos token.Pos, s string) {
 	f.buf.insert(f.fset.Position(pos).Offset, s)
 }
 
+// funcExtents returns the extent of each function in the file which could
+// contain blocks: declared functions, and function literals outside of them.
+// literals are named the way cmd/cover names them.
+func (f *file) funcExtents() []block {
+	var extents []block
+	for _, decl := range f.syntax.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok {
+			if d.Body != nil {
+				e := f.newBlock(d.Pos(), d.End(), 0)
+				e.kind = declExtent
+				e.name = funcDeclName(d)
+				f.setBody(&e, d.Body)
+				extents = append(extents, e)
+			}
+			continue
+		}
+		ast.Inspect(decl, func(n ast.Node) bool {
+			lit, ok := n.(*ast.FuncLit)
+			if !ok {
+				return true
+			}
+			e := f.newBlock(lit.Pos(), lit.End(), 0)
+			e.kind = litExtent
+			e.name = fmt.Sprintf("func.L%d.C%d", e.startLine, e.startCol)
+			f.setBody(&e, lit.Body)
+			extents = append(extents, e)
+			return false
+		})
+	}
+	return extents
+}
+
+// setBody records where the code in a function's body starts: its first
+// statement, or the closing brace if it has none.
+func (f *file) setBody(e *block, body *ast.BlockStmt) {
+	start := body.Rbrace
+	if len(body.List) > 0 {
+		start = body.List[0].Pos()
+	}
+	pos := f.fset.Position(start)
+	e.bodyLine, e.bodyCol = pos.Line, pos.Column
+}
+
+// sourceExtent returns the extent of the whole file, naming the absolute path
+// of its source. the compiler runs in the package's directory, so that's where
+// relative paths are from.
+func (f *file) sourceExtent(path string) (block, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return block{}, err
+	}
+	e := f.newBlock(f.syntax.FileStart, f.syntax.FileEnd, 0)
+	e.kind = sourceExtent
+	e.name = abs
+	return e, nil
+}
+
+// nosplit functions in the standard library, mostly the runtime, must fit in a
+// small fixed amount of stack, which the calls we add could push them over, or
+// run where stack can't grow at all. elsewhere, they're counted like any other.
+func (f *file) nosplit(fn *ast.FuncDecl) bool {
+	if !f.std || fn.Doc == nil {
+		return false
+	}
+	for _, c := range fn.Doc.List {
+		if c.Text == "//go:nosplit" {
+			return true
+		}
+	}
+	return false
+}
+
 func (f *file) Visit(node ast.Node) ast.Visitor {
 	if node == nil {
 		return nil
 	}
 
 	switch n := node.(type) {
+	case *ast.FuncDecl:
+		if f.nosplit(n) {
+			return nil
+		}
 	// List of nodes which implement ast.Stmt from:
 	// https://github.com/golang/go/blob/09aeb6e33ab426eff4676a3baf694d5a3019e9fc/src/go/ast/ast.go#L849
 	case *ast.BadStmt:
@@ -269,6 +586,19 @@ func (f *file) Visit(node ast.Node) ast.Visitor {
 		f.addStmtCounter(n)
 	case *ast.EmptyStmt:
 	case *ast.LabeledStmt:
+		if f.labels == nil {
+			f.labels = make(map[ast.Stmt]*ast.LabeledStmt)
+		}
+		f.labels[n.Stmt] = n
+		if isBreakTarget(n.Stmt) {
+			// break and continue refer to the statement by its label, so the
+			// counter can't come between them.
+			f.addCounter(n.Pos(), n.Pos(), n.Colon+1)
+		} else {
+			// the label may be the target of a goto, so count it after the
+			// colon where jumping to it will reach the counter too.
+			f.addCounter(n.Colon+1, n.Pos(), n.Colon+1)
+		}
 	case *ast.ExprStmt:
 		f.addStmtCounter(n)
 	case *ast.SendStmt:
@@ -278,18 +608,46 @@ func (f *file) Visit(node ast.Node) ast.Visitor {
 	case *ast.AssignStmt:
 		f.addStmtCounter(n)
 	case *ast.GoStmt:
+		f.addStmtCounter(n)
 	case *ast.DeferStmt:
+		f.addStmtCounter(n)
 	case *ast.ReturnStmt:
 		f.addStmtCounter(n)
 	case *ast.BranchStmt:
+		f.addStmtCounter(n)
+		if n.Tok == token.CONTINUE {
+			f.addContinueCounter(n)
+		}
 	case *ast.BlockStmt:
 	case *ast.IfStmt:
-		// TODO: do the weird offset else if --> else { if { ... }} thing
-
 		if n.Init != nil {
 			f.addCounter(n.Pos(), n.Init.Pos(), n.Init.End())
 		}
+		f.addCondCounters(n.Cond)
 		ast.Walk(f, n.Body)
+		switch e := n.Else.(type) {
+		case *ast.BlockStmt:
+			// like an empty range body, an empty else would otherwise be
+			// invisible.
+			if len(e.List) == 0 {
+				f.addCounter(e.Lbrace+1, e.Lbrace, e.Rbrace+1)
+			}
+			ast.Walk(f, e)
+		case *ast.IfStmt:
+			// there's nowhere to put a counter between "else" and "if", so
+			// like cmd/cover we turn
+			//	if a {} else if b {}
+			// into
+			//	if a {} else { if b {} }
+			// and count the else-if's condition (or its init statement, if it
+			// has one) inside the new block.
+			f.insert(e.Pos(), "{")
+			if e.Init == nil {
+				f.addCounter(e.Pos(), e.Pos(), e.Cond.End())
+			}
+			ast.Walk(f, e)
+			f.insert(e.End(), "}")
+		}
 		return nil
 	case *ast.CaseClause:
 		// case/comm clauses aren't covered, only their bodies are.
@@ -304,55 +662,273 @@ func (f *file) Visit(node ast.Node) ast.Visitor {
 		return nil
 	case *ast.SwitchStmt:
 		if n.Init != nil {
-			f.addCounter(n.Pos(), n.Init.Pos(), n.Init.End())
+			f.addCounter(f.stmtStart(n), n.Init.Pos(), n.Init.End())
 		}
+		f.addSwitchCondCounters(n)
 		ast.Walk(f, n.Body)
 		return nil
 	case *ast.TypeSwitchStmt:
 		if n.Init != nil {
-			f.addCounter(n.Pos(), n.Init.Pos(), n.Init.End())
+			f.addCounter(f.stmtStart(n), n.Init.Pos(), n.Init.End())
 		}
 		ast.Walk(f, n.Body)
 		return nil
 	case *ast.SelectStmt:
-	case *ast.ForStmt:
-		// TODO: prepend counter for Init stmt. Post stmt counter should go
-		// just in front of the closing Paren (easy) and before scoped
-		// "continue" (gross)
+		f.addCounter(f.stmtStart(n), n.Pos(), n.Select+token.Pos(len("select")))
 		ast.Walk(f, n.Body)
 		return nil
+	case *ast.ForStmt:
+		f.visitFor(n)
+		return nil
 	case *ast.RangeStmt:
+		f.visitRange(n)
+		return nil
 	}
 
 	return f
 }
 
-func (f *file) addCounter(at, start, end token.Pos) {
-	b := f.newBlock(start, end)
-	str := fmt.Sprintf("%s();", b.coverVar())
-	f.insert(at, str)
+// visitFor instruments the init and post statements of a for loop.
+//
+// The post statement runs whenever an iteration of the body finishes, so its
+// counter goes just in front of the body's closing brace and in front of every
+// continue statement which targets the loop.
+func (f *file) visitFor(n *ast.ForStmt) {
+	if n.Init != nil {
+		f.addCounter(f.stmtStart(n), n.Init.Pos(), n.Init.End())
+	}
+	f.addCondCounters(n.Cond)
+
+	l := &loop{label: f.labelName(n)}
+	if n.Post != nil {
+		l.post = f.newCounter(n.Post.Pos(), n.Post.End(), 1)
+		f.insert(n.Body.Rbrace, ";"+l.post)
+	}
+	f.walkLoop(l, n.Body)
+}
+
+// visitRange instruments a range loop.
+//
+// The header ("for k, v := range x") gets its own counter, so that ranging
+// over nothing can be told apart from never reaching the loop at all. An empty
+// body also gets a counter, since it would otherwise be invisible.
+func (f *file) visitRange(n *ast.RangeStmt) {
+	f.addCounter(f.stmtStart(n), n.Pos(), n.X.End())
+	ast.Walk(f, n.X)
+	if len(n.Body.List) == 0 {
+		f.addCounter(n.Body.Lbrace+1, n.Body.Lbrace, n.Body.Rbrace+1)
+	}
+	f.walkLoop(&loop{label: f.labelName(n)}, n.Body)
+}
+
+func (f *file) walkLoop(l *loop, body *ast.BlockStmt) {
+	f.loops = append(f.loops, l)
+	ast.Walk(f, body)
+	f.loops = f.loops[:len(f.loops)-1]
+}
+
+// addContinueCounter counts the post statement of the loop targeted by a
+// continue statement. Labels are scoped to functions, and function literals
+// can't continue loops outside of them, so the innermost match is always the
+// right one.
+func (f *file) addContinueCounter(n *ast.BranchStmt) {
+	for i := len(f.loops) - 1; i >= 0; i-- {
+		l := f.loops[i]
+		if n.Label != nil && n.Label.Name != l.label {
+			continue
+		}
+		if l.post != "" {
+			f.insert(n.Pos(), l.post)
+		}
+		return
+	}
+}
+
+// returns where code meant to run before stmt should be inserted. for labeled
+// break targets, that's in front of the label.
+func (f *file) stmtStart(stmt ast.Stmt) token.Pos {
+	if label, ok := f.labels[stmt]; ok && isBreakTarget(stmt) {
+		return label.Pos()
+	}
+	return stmt.Pos()
+}
+
+func (f *file) labelName(stmt ast.Stmt) string {
+	if label, ok := f.labels[stmt]; ok {
+		return label.Label.Name
+	}
+	return ""
+}
+
+// reports whether stmt can be referred to by a labeled break or continue.
+func isBreakTarget(stmt ast.Stmt) bool {
+	switch stmt.(type) {
+	case *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt, *ast.TypeSwitchStmt, *ast.SelectStmt:
+		return true
+	}
+	return false
+}
+
+// newCounter adds a block and returns the statement which counts it, ready to
+// be inserted.
+func (f *file) newCounter(start, end token.Pos, numStmt int) string {
+	b := f.newBlock(start, end, numStmt)
 	f.blocks = append(f.blocks, b)
+	return fmt.Sprintf("%s();", b.coverVar())
 }
 
-func (f *file) addStmtCounter(stmt ast.Stmt) {
-	f.addCounter(stmt.Pos(), stmt.Pos(), stmt.End())
+// addCondCounters adds whichever branch and condition counters we're
+// configured to add to the condition of an if, for or switch statement. cond
+// may be nil, for loops without one.
+func (f *file) addCondCounters(cond ast.Expr) {
+	if cond == nil {
+		return
+	}
+	if f.branch {
+		f.wrapCond(cond, branchBlock, true, true)
+	}
+	// without type information, we can't wrap operands where the type of the
+	// expression matters, since their type becomes bool. the conditions of
+	// statements only need to be boolean, so they're safe.
+	if f.conditions && isLogical(cond) {
+		f.addOperandCounters(cond, true, true)
+	}
 }
 
-func (f *file) addMainInit() {
-	var main *ast.FuncDecl
-	for _, decl := range f.syntax.Decls {
-		if d, ok := decl.(*ast.FuncDecl); ok && d.Name.Name == "main" {
-			main = d
-			break
+// addSwitchCondCounters adds condition counters to each case of a switch
+// without a tag, since they're all conditions.
+func (f *file) addSwitchCondCounters(n *ast.SwitchStmt) {
+	if n.Tag != nil {
+		return
+	}
+	for _, s := range n.Body.List {
+		for _, cond := range s.(*ast.CaseClause).List {
+			f.addCondCounters(cond)
 		}
 	}
-	if main == nil || main.Body == nil {
+}
+
+// addOperandCounters counts each operand of the && and || expressions in e.
+// decidesTrue and decidesFalse are whether e's value is the value of the whole
+// condition, when true and when false.
+func (f *file) addOperandCounters(e ast.Expr, decidesTrue, decidesFalse bool) {
+	if !isLogical(e) {
+		f.wrapCond(e, condBlock, decidesTrue, decidesFalse)
 		return
 	}
-	if main.Body == nil {
+	b := ast.Unparen(e).(*ast.BinaryExpr)
+	// the left side short-circuits the expression when it's false for &&,
+	// or true for ||. otherwise, it's up to the right side.
+	if b.Op == token.LAND {
+		f.addOperandCounters(b.X, false, decidesFalse)
+	} else {
+		f.addOperandCounters(b.X, decidesTrue, false)
+	}
+	f.addOperandCounters(b.Y, decidesTrue, decidesFalse)
+}
+
+// reports whether e is an && or || expression.
+func isLogical(e ast.Expr) bool {
+	b, ok := ast.Unparen(e).(*ast.BinaryExpr)
+	return ok && (b.Op == token.LAND || b.Op == token.LOR)
+}
+
+// wrapCond wraps a boolean expression in a cover var which counts it each
+// time it's true or false, and passes its value through. constants are left
+// alone, so that the compiler can still drop the code they rule out.
+func (f *file) wrapCond(e ast.Expr, kind string, decidesTrue, decidesFalse bool) {
+	if f.isConst(e) {
 		return
 	}
-	f.insert(main.Body.Lbrace+1, `defer _WriteCoverage();`)
+	b := f.newBlock(e.Pos(), e.End(), 0)
+	b.kind = kind
+	b.decidesTrue, b.decidesFalse = decidesTrue, decidesFalse
+	f.blocks = append(f.blocks, b)
+	// the conversion is for expressions whose type is only based on bool.
+	f.insert(e.Pos(), b.coverVar()+"(bool(")
+	f.insert(e.End(), "))")
+}
+
+// isConst reports whether e is a constant expression, as far as can be told
+// without type checking: literals and the constants of the package, or of the
+// function e is in, combined with operators. constants from other packages
+// can't be told apart from variables, so they aren't counted as such.
+func (f *file) isConst(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.BasicLit:
+		return true
+	case *ast.Ident:
+		// the parser resolves names declared in the same file, which could
+		// be locals hiding the package's.
+		if e.Obj != nil {
+			return e.Obj.Kind == ast.Con
+		}
+		if isConst, ok := f.consts[e.Name]; ok {
+			return isConst
+		}
+		return e.Name == "true" || e.Name == "false"
+	case *ast.ParenExpr:
+		return f.isConst(e.X)
+	case *ast.UnaryExpr:
+		return e.Op != token.ARROW && e.Op != token.AND && f.isConst(e.X)
+	case *ast.BinaryExpr:
+		return f.isConst(e.X) && f.isConst(e.Y)
+	}
+	return false
+}
+
+// pkgConsts returns the names declared at the top level of a package's files,
+// and whether each is a constant.
+func pkgConsts(files []*ast.File) map[string]bool {
+	consts := make(map[string]bool)
+	for _, file := range files {
+		for _, decl := range file.Decls {
+			switch d := decl.(type) {
+			case *ast.FuncDecl:
+				if d.Recv == nil {
+					consts[d.Name.Name] = false
+				}
+			case *ast.GenDecl:
+				for _, spec := range d.Specs {
+					switch spec := spec.(type) {
+					case *ast.ValueSpec:
+						for _, name := range spec.Names {
+							consts[name.Name] = d.Tok == token.CONST
+						}
+					case *ast.TypeSpec:
+						consts[spec.Name.Name] = false
+					}
+				}
+			}
+		}
+	}
+	return consts
+}
+
+// reports whether pkg is the runtime or one of its internal packages.
+func isRuntimePkg(pkg string) bool {
+	return pkg == "runtime" || strings.HasPrefix(pkg, "runtime/internal/") || strings.HasPrefix(pkg, "internal/runtime/")
+}
+
+// addCounter adds a counter for a single statement's worth of code.
+func (f *file) addCounter(at, start, end token.Pos) {
+	f.insert(at, f.newCounter(start, end, 1))
+}
+
+func (f *file) addStmtCounter(stmt ast.Stmt) {
+	f.addCounter(stmt.Pos(), stmt.Pos(), stmt.End())
+}
+
+// addMainInit defers writing coverage in main.main, for when it returns. the
+// runtime's exit hook covers that too, but this still works if a go release
+// renames what addExitHooks patches. it's only written once either way.
+func (f *file) addMainInit() {
+	for _, decl := range f.syntax.Decls {
+		if d, ok := decl.(*ast.FuncDecl); ok && d.Recv == nil && d.Name.Name == "main" && d.Body != nil {
+			f.insert(d.Body.Lbrace+1, "defer _WriteCoverage();")
+			return
+		}
+	}
 }
 
 func copyDir(dst, src string) error {
@@ -375,19 +951,26 @@ func copyDir(dst, src string) error {
 		if !file.Type().IsRegular() {
 			continue
 		}
-		w, err := os.Create(dstPath)
-		if err != nil {
-			return err
-		}
-		defer w.Close()
-		r, err := os.Open(srcPath)
-		if err != nil {
-			return err
-		}
-		defer r.Close()
-		if _, err := io.Copy(w, r); err != nil {
+		if err := copyFile(dstPath, srcPath); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+func copyFile(dst, src string) error {
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// the go command recompiles every package whenever our config changes, since
+// it's part of the compiler's version as far as the go command can tell (see
+// printVersion). most packages aren't instrumented though, and compile to the
+// same thing every time, but for their build IDs. so we keep what the compiler
+// writes by everything which went into it, and hand that back with the new
+// build ID rather than compiling the same thing again.
+
+// the compiler's flags which take a value, as the go command passes them.
+var compileValueFlags = []string{"o", "trimpath", "p", "buildid", "goversion", "symabis", "importcfg", "asmhdr", "installsuffix", "D", "I"}
+
+// the compiler's flags which only change what it writes to the files we keep,
+// so that we know what we keep is all it wrote. the lang flag, and c for the
+// number of backend goroutines, take their values after "=".
+var compileOtherFlags = []string{"std", "complete", "nolocalimports", "pack", "race", "msan", "asan", "shared", "dynlink", "lang", "c", "N", "l"}
+
+// the environment variables only the go command reads.
+var goCommandEnv = []string{"GOCACHE", "GOTMPDIR", "GOPATH", "GOMODCACHE", "GOENV", "GOFLAGS", "GOWORK", "GOTOOLCHAIN", "GOPROXY", "GOSUMDB", "GOPRIVATE", "GONOPROXY", "GONOSUMDB", "GOINSECURE", "GOVCS", "GOAUTH", "GOTELEMETRY", "GOTELEMETRYDIR"}
+
+// compileCached runs the compiler, unless it already compiled the same thing,
+// in which case its output from then is used.
+func compileCached(tool string, args []string) error {
+	key, err := compileKey(tool, args)
+	if err != nil || key == "" {
+		if err == nil {
+			err = runTool(tool, args)
+		}
+		return err
+	}
+
+	dir, err := cacheDir()
+	if err != nil {
+		return err
+	}
+	dir = filepath.Join(dir, "compiled")
+	_, out := getFlag(args, "o")
+	_, buildid := getFlag(args, "buildid")
+	_, asmhdr := getFlag(args, "asmhdr")
+
+	archive, err := os.ReadFile(filepath.Join(dir, key+".a"))
+	if err == nil {
+		// the old build ID is in the archive as many times as the new one
+		// would have been, and it's the same length.
+		oldID, err := archiveBuildID(filepath.Join(dir, key+".a"))
+		if err != nil {
+			return err
+		}
+		if len(oldID) == len(buildid) {
+			if asmhdr != "" {
+				if err := copyFile(asmhdr, filepath.Join(dir, key+".h")); err != nil {
+					return err
+				}
+			}
+			return os.WriteFile(out, bytes.ReplaceAll(archive, []byte(oldID), []byte(buildid)), 0666)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// anything the compiler prints, the go command keeps with its output, so
+	// only a quiet compile can be used again.
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(tool, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	os.Stdout.Write(stdout.Bytes())
+	os.Stderr.Write(stderr.Bytes())
+	if err != nil || stdout.Len() > 0 || stderr.Len() > 0 {
+		return err
+	}
+
+	// written elsewhere and renamed into place, since builds sharing a cache
+	// can compile the same package at once; see compile.
+	tmpDir := filepath.Join(dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0777); err != nil {
+		return err
+	}
+	if asmhdr != "" {
+		if err := keepFile(tmpDir, filepath.Join(dir, key+".h"), asmhdr); err != nil {
+			return err
+		}
+	}
+	return keepFile(tmpDir, filepath.Join(dir, key+".a"), out)
+}
+
+// keepFile copies src to dst by way of tmpDir.
+func keepFile(tmpDir, dst, src string) error {
+	tmp, err := os.CreateTemp(tmpDir, filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := copyFile(tmp.Name(), src); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// compileKey returns a key for what the compiler would write given args, or ""
+// if it's given flags we don't know enough about to tell.
+//
+// the go command gives each package a directory in $WORK, which changes from
+// build to build, so it's left out of paths; the compiler leaves it out of
+// what it writes too, with -trimpath. the files the compiler reads are keyed by
+// their contents, and the packages it imports by their content IDs.
+func compileKey(tool string, args []string) (string, error) {
+	idx, files := goFiles(args)
+	if idx < 0 {
+		return "", nil
+	}
+	_, out := getFlag(args, "o")
+	workDir := filepath.Dir(out)
+
+	h := sha256.New()
+	toolID, err := exeBuildID(tool)
+	if err != nil {
+		return "", err
+	}
+	hashFields(h, tool, toolID)
+	// GOARCH, GOEXPERIMENT and the like change what the compiler does, but
+	// what only the go command reads, like where modules and caches are,
+	// doesn't.
+	var env []string
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "GO") && !slices.Contains(goCommandEnv, name) {
+			env = append(env, kv)
+		}
+	}
+	slices.Sort(env)
+	hashFields(h, env...)
+
+	trim := func(path string) string {
+		if rel, err := filepath.Rel(workDir, path); err == nil && filepath.IsLocal(rel) {
+			return filepath.Join("$WORK", rel)
+		}
+		return strings.ReplaceAll(path, workDir, "$WORK")
+	}
+	for i := 0; i < idx; i++ {
+		name, _, _ := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		switch {
+		case !strings.HasPrefix(args[i], "-"):
+			return "", nil
+		case slices.Contains(compileOtherFlags, name):
+			hashFields(h, args[i])
+			continue
+		case !slices.Contains(compileValueFlags, name) || i+1 >= idx:
+			return "", nil
+		}
+		i++
+		switch name {
+		case "o", "buildid", "asmhdr":
+			hashFields(h, args[i-1])
+		case "importcfg":
+			cfg, err := importCfgKey(args[i])
+			if err != nil {
+				return "", err
+			}
+			hashFields(h, args[i-1], cfg)
+		case "symabis":
+			sum, err := fileKey(args[i])
+			if err != nil {
+				return "", err
+			}
+			hashFields(h, args[i-1], sum)
+		default:
+			hashFields(h, args[i-1], trim(args[i]))
+		}
+	}
+	// the compiler's directory only matters for making the paths of files
+	// absolute, which the go command only leaves for those of main packages.
+	for _, file := range files {
+		sum, err := fileKey(file)
+		if err != nil {
+			return "", err
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return "", err
+		}
+		hashFields(h, trim(abs), sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func fileKey(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+// importCfgKey returns the contents of an importcfg, with each package's file
+// replaced by its content ID.
+func importCfgKey(path string) (string, error) {
+	cfg, err := readImportCfg(path)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, line := range cfg.other {
+		fmt.Fprintf(&b, "%s\n", line)
+	}
+	var pkgs []string
+	for pkg := range cfg.pkg {
+		pkgs = append(pkgs, pkg)
+	}
+	slices.Sort(pkgs)
+	for _, pkg := range pkgs {
+		id, err := archiveBuildID(cfg.pkg[pkg])
+		if err != nil {
+			return "", err
+		}
+		_, content, _ := strings.Cut(id, "/")
+		fmt.Fprintf(&b, "packagefile %s=%s\n", pkg, content)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+)
+
+// this file encodes the meta-data half of the coverage data files written by
+// programs built with 'go build -cover' (see internal/coverage in the standard
+// library), so that 'go tool covdata' can read ours too. the meta-data never
+// changes after linking, so we encode it all then, and the program only writes
+// out its counters.
+
+var covMetaMagic = [4]byte{0x00, 0x63, 0x76, 0x6d}
+
+const (
+	covMetaFileVersion = 1
+	covMetaHeaderSize  = 16 + 4 + 4 + 4 + 4 + 4 + 4 + 4 // of each package
+	covMetaFileHeader  = 56                             // of the whole file
+
+	covGranularityPerBlock = 1
+)
+
+var covModes = map[string]uint8{"set": 1, "count": 2, "atomic": 3}
+
+// a package, as described in a meta-data file.
+type covPkg struct {
+	path, name string
+	funcs      []*covFunc
+
+	// what funcs is made of, while reading the cache.
+	extents []covExtent
+	loose   []*covFunc
+}
+
+type covFunc struct {
+	name, file string
+	lit        bool
+	units      []covUnit
+}
+
+// a block of code with its own counter.
+type covUnit struct {
+	stLine, stCol, enLine, enCol, numStmt uint32
+	counter                               string // the generated var counting it
+}
+
+// encodes the meta-data file for pkgs, returning it and its hash, which is also
+// what names it.
+func encodeCovMeta(pkgs []*covPkg, mode string) ([]byte, [16]byte) {
+	blobs := make([][]byte, len(pkgs))
+	h := fnv.New128a()
+	for i, p := range pkgs {
+		var pkgHash [16]byte
+		blobs[i], pkgHash = p.encode()
+		h.Write(pkgHash[:])
+	}
+	h.Write([]byte(mode))
+	h.Write([]byte("perblock"))
+	var hash [16]byte
+	copy(hash[:], h.Sum(nil))
+
+	var stab stringTab
+	stab.lookup("")
+	stOffset := covMetaFileHeader + 16*len(blobs)
+	preamble := stOffset + stab.size()
+	total := preamble
+	for _, b := range blobs {
+		total += len(b)
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write(covMetaMagic[:])
+	le(buf, uint32(covMetaFileVersion))
+	le(buf, uint64(total))
+	le(buf, uint64(len(blobs)))
+	buf.Write(hash[:])
+	le(buf, uint32(stOffset))
+	le(buf, uint32(stab.size()))
+	buf.WriteByte(covModes[mode])
+	buf.WriteByte(covGranularityPerBlock)
+	buf.Write(make([]byte, 6))
+	off := preamble
+	for _, b := range blobs {
+		le(buf, uint64(off))
+		off += len(b)
+	}
+	for _, b := range blobs {
+		le(buf, uint64(len(b)))
+	}
+	stab.writeTo(buf)
+	for _, b := range blobs {
+		buf.Write(b)
+	}
+	return buf.Bytes(), hash
+}
+
+// encodes the package's meta-data "symbol", returning it and its hash.
+func (p *covPkg) encode() ([]byte, [16]byte) {
+	var stab stringTab
+	stab.lookup("")
+	pkgPath := stab.lookup(p.path)
+	pkgName := stab.lookup(p.name)
+	modPath := stab.lookup("")
+
+	h := fnv.New128a()
+	io.WriteString(h, p.path)
+	io.WriteString(h, p.name)
+	funcs := make([][]byte, len(p.funcs))
+	for i, fn := range p.funcs {
+		io.WriteString(h, fn.name)
+		io.WriteString(h, fn.file)
+		var enc []byte
+		enc = binary.AppendUvarint(enc, uint64(len(fn.units)))
+		enc = binary.AppendUvarint(enc, uint64(stab.lookup(fn.name)))
+		enc = binary.AppendUvarint(enc, uint64(stab.lookup(fn.file)))
+		for _, u := range fn.units {
+			for _, v := range []uint32{u.stLine, u.stCol, u.enLine, u.enCol, u.numStmt} {
+				enc = binary.AppendUvarint(enc, uint64(v))
+				binary.Write(h, binary.LittleEndian, v)
+			}
+		}
+		var lit uint32
+		if fn.lit {
+			lit = 1
+		}
+		enc = binary.AppendUvarint(enc, uint64(lit))
+		binary.Write(h, binary.LittleEndian, lit)
+		funcs[i] = enc
+	}
+	var hash [16]byte
+	copy(hash[:], h.Sum(nil))
+
+	buf := new(bytes.Buffer)
+	le(buf, uint32(0)) // length, filled in below
+	le(buf, pkgName)
+	le(buf, pkgPath)
+	le(buf, modPath)
+	buf.Write(hash[:])
+	buf.Write(make([]byte, 4))
+	le(buf, uint32(len(stab.strs)))
+	le(buf, uint32(len(funcs)))
+	off := covMetaHeaderSize + stab.size() + 4*len(funcs)
+	for _, fn := range funcs {
+		le(buf, uint32(off))
+		off += len(fn)
+	}
+	stab.writeTo(buf)
+	for _, fn := range funcs {
+		buf.Write(fn)
+	}
+	b := buf.Bytes()
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	return b, hash
+}
+
+func le(w io.Writer, v any) {
+	binary.Write(w, binary.LittleEndian, v)
+}
+
+// the string tables in coverage data files.
+type stringTab struct {
+	index map[string]uint32
+	strs  []string
+}
+
+func (t *stringTab) lookup(s string) uint32 {
+	if i, ok := t.index[s]; ok {
+		return i
+	}
+	if t.index == nil {
+		t.index = make(map[string]uint32)
+	}
+	i := uint32(len(t.strs))
+	t.index[s] = i
+	t.strs = append(t.strs, s)
+	return i
+}
+
+func (t *stringTab) size() int {
+	return len(t.bytes())
+}
+
+func (t *stringTab) writeTo(buf *bytes.Buffer) {
+	buf.Write(t.bytes())
+}
+
+func (t *stringTab) bytes() []byte {
+	b := binary.AppendUvarint(nil, uint64(len(t.strs)))
+	for _, s := range t.strs {
+		b = binary.AppendUvarint(b, uint64(len(s)))
+		b = append(b, s...)
+	}
+	return b
+}
+
+// a function's extent in a file, as recorded in the cache.
+type covExtent struct {
+	file                                 string
+	startLine, startCol, endLine, endCol int
+	fn                                   *covFunc
+}
+
+func (e covExtent) contains(file string, u covUnit) bool {
+	if file != e.file {
+		return false
+	}
+	afterStart := int(u.stLine) > e.startLine || (int(u.stLine) == e.startLine && int(u.stCol) >= e.startCol)
+	beforeEnd := int(u.enLine) < e.endLine || (int(u.enLine) == e.endLine && int(u.enCol) <= e.endCol)
+	return afterStart && beforeEnd
+}
+
+// adds a unit from file to the function containing it, or to one of its own
+// if, somehow, none do. like cmd/cover, literals inside a function are counted
+// as part of it, which is why they have no extents of their own.
+func (p *covPkg) addUnit(file string, u covUnit) {
+	for _, e := range p.extents {
+		if e.contains(file, u) {
+			e.fn.units = append(e.fn.units, u)
+			return
+		}
+	}
+	p.loose = append(p.loose, &covFunc{
+		name:  fmt.Sprintf("func.L%d.C%d", u.stLine, u.stCol),
+		file:  file,
+		lit:   true,
+		units: []covUnit{u},
+	})
+}
+
+// finish settles which functions are in the package, once all its units have
+// been added.
+func (p *covPkg) finish() {
+	for _, e := range p.extents {
+		if len(e.fn.units) > 0 {
+			p.funcs = append(p.funcs, e.fn)
+		}
+	}
+	p.funcs = append(p.funcs, p.loose...)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// diff reports how much of the code changed by a patch ran, going by a
+// profile: patch coverage, for reviewing changes.
+func diff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	patch := fs.String("diff", "", "read the unified diff from `file` instead of stdin")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cover diff [-diff file] profile")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	p, err := readProfile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	r := io.Reader(os.Stdin)
+	name := "stdin"
+	if *patch != "" {
+		f, err := os.Open(*patch)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		r, name = f, *patch
+	}
+	changed, err := parseDiff(r, name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cached, err := cachedFiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report, err := patchCoverage(p, changed, cached)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	report.write(os.Stdout)
+	return 0
+}
+
+// parseDiff returns the lines added or changed in each file of a unified diff,
+// by the file's path after the change. deleted files have none.
+func parseDiff(r io.Reader, name string) (map[string][]int, error) {
+	changed := make(map[string][]int)
+	var file string    // "" outside of any file, or for deleted ones
+	var line, left int // the next line in the new file, and how many the hunk has left
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		text := scanner.Text()
+		switch {
+		case left > 0 && (text == "" || text[0] == ' '):
+			line++
+			left--
+		case left > 0 && text[0] == '+':
+			if file != "" {
+				changed[file] = append(changed[file], line)
+			}
+			line++
+			left--
+		case left > 0 && (text[0] == '-' || text[0] == '\\'):
+			// removed lines, and "\ No newline at end of file", aren't in
+			// the new file.
+		case strings.HasPrefix(text, "+++ "):
+			file = diffPath(text[len("+++ "):])
+		case strings.HasPrefix(text, "@@ "):
+			// @@ -start,len +start,len @@
+			fields := strings.Fields(text)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("%s:%d: invalid hunk header %q", name, n, text)
+			}
+			start, length, ok := strings.Cut(fields[2][1:], ",")
+			var err error
+			if line, err = strconv.Atoi(start); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid hunk header %q", name, n, text)
+			}
+			left = 1
+			if ok {
+				if left, err = strconv.Atoi(length); err != nil {
+					return nil, fmt.Errorf("%s:%d: invalid hunk header %q", name, n, text)
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return changed, nil
+}
+
+// diffPath returns the path of a file from the "+++" line of a diff, without
+// git's "b/" prefix, or "" if the file was deleted.
+func diffPath(s string) string {
+	// there may be a timestamp after a tab.
+	s, _, _ = strings.Cut(s, "\t")
+	if s == "/dev/null" {
+		return ""
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if rest, ok := strings.CutPrefix(s, "b/"); ok {
+		return rest
+	}
+	return s
+}
+
+// the coverage of the lines changed in one file.
+type patchFile struct {
+	name      string // as in the diff
+	covered   int
+	uncovered []int
+}
+
+type patchReport struct {
+	files []patchFile
+}
+
+// patchCoverage works out which changed lines ran. files in the diff are
+// matched with files in the profile by where we know their sources are, or by
+// the end of their names, so paths relative to the root of the module work. a
+// changed line counts when there's a block on it, and is covered if its
+// innermost block ran.
+func patchCoverage(p *profile, changed map[string][]int, cached map[string]*cachedFile) (*patchReport, error) {
+	lines, err := p.lineCounts() // by file in the profile
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	report := new(patchReport)
+	for _, name := range names {
+		file, ok := matchProfileFile(name, lines, cached)
+		if !ok {
+			continue
+		}
+		pf := patchFile{name: name}
+		for _, l := range changed[name] {
+			count, ok := lines[file][l]
+			switch {
+			case !ok:
+			case count > 0:
+				pf.covered++
+			default:
+				pf.uncovered = append(pf.uncovered, l)
+			}
+		}
+		if pf.covered > 0 || len(pf.uncovered) > 0 {
+			report.files = append(report.files, pf)
+		}
+	}
+	return report, nil
+}
+
+// matchProfileFile returns the file in the profile which the diff calls name.
+// if several could be, it's the one with the shortest source path, or failing
+// that name, being closest to the root of the repository or module.
+func matchProfileFile(name string, lines map[string]map[int]uint64, cached map[string]*cachedFile) (string, bool) {
+	name = path.Clean(name)
+	matches := func(s string) bool {
+		return s == name || strings.HasSuffix(s, "/"+name)
+	}
+	shorter := func(a, b string) bool {
+		return b == "" || len(a) < len(b) || (len(a) == len(b) && a < b)
+	}
+	var bySource, src, byName string
+	for file := range lines {
+		if cf := cached[file]; cf != nil && cf.source != "" {
+			s := filepath.ToSlash(cf.source)
+			if matches(s) && shorter(s, src) {
+				bySource, src = file, s
+			}
+		}
+		if matches(file) && shorter(file, byName) {
+			byName = file
+		}
+	}
+	if bySource != "" {
+		return bySource, true
+	}
+	return byName, byName != ""
+}
+
+func (r *patchReport) write(w io.Writer) {
+	var covered, total int
+	for _, f := range r.files {
+		n := f.covered + len(f.uncovered)
+		covered += f.covered
+		total += n
+		fmt.Fprintf(w, "%s: %d/%d changed lines covered (%.1f%%)", f.name, f.covered, n, 100*float64(f.covered)/float64(n))
+		if len(f.uncovered) > 0 {
+			fmt.Fprintf(w, ", not covered: %s", lineRanges(f.uncovered))
+		}
+		fmt.Fprintln(w)
+	}
+	if total == 0 {
+		fmt.Fprintln(w, "patch coverage: no changed lines with statements")
+		return
+	}
+	fmt.Fprintf(w, "patch coverage: %.1f%% (%d/%d changed lines)\n", 100*float64(covered)/float64(total), covered, total)
+}
+
+// lineRanges formats sorted line numbers as e.g. "3, 5-7, 10".
+func lineRanges(lines []int) string {
+	var ranges []string
+	for i := 0; i < len(lines); {
+		j := i
+		for j+1 < len(lines) && lines[j+1] == lines[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(lines[i]))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", lines[i], lines[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ", ")
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+)
+
+// the runtime calls os.Exit's hooks, and returning from main's, from
+// runExitHooks, and it calls preprintpanics right before crashing with an
+// unrecovered panic, in whichever goroutine panicked. those are the only places
+// we get to run code as a program exits, so we patch them to call a hook of our
+// own, which the cover vars package sets to write the profile.
+var runtimeHooked = []string{"runExitHooks", "preprintpanics"}
+
+// what signalRefsFunc uses from os/signal, which could change just the same:
+// handlers locks with an embedded mutex, its ref is an array of int64, and
+// numSig is a constant which compares with an int.
+var signalRefsUses = []string{"handlers.Mutex", "handlers.ref", "numSig"}
+
+const (
+	exitHookVar = "coverExitHook"
+
+	// the linkname lets the cover vars package set it, despite the linker
+	// otherwise refusing to let anything outside the runtime refer to it.
+	exitHookDecl = `// set by ` + coverPkgPath + ` to write coverage profiles when the program exits.
+//
+//go:linkname ` + exitHookVar + `
+var ` + exitHookVar + ` func()
+`
+
+	// the cover vars package handles signals for programs which don't, but
+	// can't tell whether they do without asking os/signal, which it can't
+	// refer to directly unless we put something there. so the runtime holds
+	// a function os/signal sets, returning how many channels a signal is sent
+	// to.
+	signalRefsVar  = "coverSignalRefs"
+	signalRefsDecl = `// set by os/signal, for ` + coverPkgPath + ` to tell whether the program handles a signal.
+//
+//go:linkname ` + signalRefsVar + `
+var ` + signalRefsVar + ` func(sig int) int64
+`
+	signalRefsFunc = `//go:linkname ` + signalRefsVar + ` runtime.` + signalRefsVar + `
+var ` + signalRefsVar + ` func(sig int) int64
+
+func init() {
+	` + signalRefsVar + ` = func(sig int) int64 {
+		if sig < 0 || sig >= numSig {
+			return 0
+		}
+		handlers.Lock()
+		defer handlers.Unlock()
+		return handlers.ref[sig]
+	}
+}
+`
+)
+
+// addExitHooks adds a call to our exit hook to the top of each function in
+// runtimeHooked found in the file, and records which ones it found.
+func (f *file) addExitHooks(hooked map[string]bool) {
+	for _, decl := range f.syntax.Decls {
+		d, ok := decl.(*ast.FuncDecl)
+		if !ok || d.Recv != nil || d.Body == nil {
+			continue
+		}
+		for _, name := range runtimeHooked {
+			if d.Name.Name == name {
+				f.insert(d.Body.Lbrace+1, fmt.Sprintf("if %s != nil { %[1]s() };", exitHookVar))
+				hooked[name] = true
+			}
+		}
+	}
+}
+
+// findSignalRefs records which of signalRefsUses are declared in the file, in
+// the shape signalRefsFunc needs.
+func (f *file) findSignalRefs(found map[string]bool) {
+	for _, decl := range f.syntax.Decls {
+		d, ok := decl.(*ast.GenDecl)
+		if !ok {
+			continue
+		}
+		for _, spec := range d.Specs {
+			s, ok := spec.(*ast.ValueSpec)
+			if !ok {
+				continue
+			}
+			for _, name := range s.Names {
+				switch name.Name {
+				case "numSig":
+					if d.Tok == token.CONST && (s.Type == nil || isIdent(s.Type, "int")) {
+						found["numSig"] = true
+					}
+				case "handlers":
+					st, ok := s.Type.(*ast.StructType)
+					if !ok {
+						continue
+					}
+					for _, field := range st.Fields.List {
+						if len(field.Names) == 0 && isMutex(field.Type) {
+							found["handlers.Mutex"] = true
+						}
+						for _, n := range field.Names {
+							if n.Name != "ref" {
+								continue
+							}
+							if arr, ok := field.Type.(*ast.ArrayType); ok && arr.Len != nil && isIdent(arr.Elt, "int64") {
+								found["handlers.ref"] = true
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func isIdent(e ast.Expr, name string) bool {
+	id, ok := e.(*ast.Ident)
+	return ok && id.Name == name
+}
+
+// reports whether e is sync.Mutex or sync.RWMutex, either of which has the Lock
+// and Unlock methods signalRefsFunc calls.
+func isMutex(e ast.Expr) bool {
+	sel, ok := e.(*ast.SelectorExpr)
+	return ok && isIdent(sel.X, "sync") && (sel.Sel.Name == "Mutex" || sel.Sel.Name == "RWMutex")
+}
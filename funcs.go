@@ -0,0 +1,73 @@
+package main
+
+import (
+	"go/ast"
+	"strconv"
+)
+
+// funcFile instruments a file with a single counter at the top of each
+// function, which is enough to tell whether it was ever called, and much
+// cheaper than counting every statement.
+type funcFile struct {
+	*file
+
+	name string // of the function being visited, or "" at the top level
+	lit  bool   // whether that function is a literal
+	lits *int   // number of function literals seen in it so far
+}
+
+func (f *funcFile) Visit(node ast.Node) ast.Visitor {
+	switch n := node.(type) {
+	case *ast.FuncDecl:
+		// functions named _ can never be called.
+		if n.Body == nil || n.Name.Name == "_" || f.nosplit(n) {
+			return nil
+		}
+		name := funcDeclName(n)
+		f.addFuncCounter(n.Body, name)
+		return &funcFile{file: f.file, name: name, lits: new(int)}
+	case *ast.FuncLit:
+		// name literals the way the compiler does: main.func1 for the first
+		// one in main, main.func1.1 for the first one in that, and so on.
+		*f.lits++
+		var name string
+		switch {
+		case f.name == "":
+			name = "glob..func" + strconv.Itoa(*f.lits)
+		case f.lit:
+			name = f.name + "." + strconv.Itoa(*f.lits)
+		default:
+			name = f.name + ".func" + strconv.Itoa(*f.lits)
+		}
+		f.addFuncCounter(n.Body, name)
+		return &funcFile{file: f.file, name: name, lit: true, lits: new(int)}
+	}
+	return f
+}
+
+func (f *funcFile) addFuncCounter(body *ast.BlockStmt, name string) {
+	b := f.newBlock(body.Lbrace, body.Rbrace+1, 1)
+	b.kind = funcBlock
+	b.name = name
+	f.blocks = append(f.blocks, b)
+	f.insert(body.Lbrace+1, b.coverVar()+"();")
+}
+
+// returns the name of a function as cmd/cover would print it, e.g. "*T.M" for
+// methods. like cmd/cover, methods of generic types are left as just "M".
+func funcDeclName(n *ast.FuncDecl) string {
+	name := n.Name.Name
+	if n.Recv == nil || len(n.Recv.List) != 1 {
+		return name
+	}
+	t := n.Recv.List[0].Type
+	star := ""
+	if p, ok := t.(*ast.StarExpr); ok {
+		t = p.X
+		star = "*"
+	}
+	if id, ok := t.(*ast.Ident); ok {
+		return star + id.Name + "." + name
+	}
+	return name
+}
@@ -2,8 +2,9 @@ module ehden.net/cover
 
 go 1.22.4
 
+require github.com/rogpeppe/go-internal v1.12.0
+
 require (
-	github.com/rogpeppe/go-internal v1.12.0 // indirect
 	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
 	golang.org/x/tools v0.1.12 // indirect
 )
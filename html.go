@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"slices"
+)
+
+// htmlReport writes a profile as HTML, with the source of each file coloured
+// by how much of it ran. the sources are found through what we recorded when
+// compiling, so this works for any package we instrumented, wherever it came
+// from, as long as it was built by this version of cover.
+func htmlReport(args []string) int {
+	fs := flag.NewFlagSet("html", flag.ContinueOnError)
+	out := fs.String("o", "", "write the report to `file` instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cover html [-o file] profile")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	p, err := readProfile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cached, err := cachedFiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = withOutput(*out, func(w io.Writer) error {
+		return writeHTML(w, p, cached)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// a file in the report.
+type htmlFile struct {
+	Name     string
+	Coverage float64
+	Body     template.HTML
+}
+
+func writeHTML(w io.Writer, p *profile, cached map[string]*cachedFile) error {
+	byFile := make(map[string][]profileBlock)
+	var names []string
+	var maxCount uint64
+	for _, b := range p.blocks {
+		file, _, _, _, _, err := parseBlockPos(b.pos)
+		if err != nil {
+			return err
+		}
+		if _, ok := byFile[file]; !ok {
+			names = append(names, file)
+		}
+		byFile[file] = append(byFile[file], b)
+		maxCount = max(maxCount, b.count)
+	}
+	slices.Sort(names)
+
+	var files []htmlFile
+	for _, name := range names {
+		blocks := byFile[name]
+		var body template.HTML
+		var src []byte
+		err := os.ErrNotExist
+		if cf := cached[name]; cf != nil && cf.source != "" {
+			src, err = os.ReadFile(cf.source)
+		}
+		if err != nil {
+			body = template.HTML(template.HTMLEscapeString("no source found for " + name))
+		} else if body, err = annotate(src, blocks, p.mode, maxCount); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		files = append(files, htmlFile{
+			Name:     name,
+			Coverage: percentCovered(blocks),
+			Body:     body,
+		})
+	}
+	return htmlTemplate.Execute(w, struct {
+		Set   bool
+		Files []htmlFile
+	}{p.mode == "set", files})
+}
+
+// percentCovered returns the percentage of statements in blocks which ran.
+func percentCovered(blocks []profileBlock) float64 {
+	var total, covered int
+	for _, b := range blocks {
+		total += b.numStmt
+		if b.count > 0 {
+			covered += b.numStmt
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(total)
+}
+
+// annotate escapes src, wrapping the code in each block in a span whose class
+// says how often it ran. where blocks nest, as functions do when only counting
+// calls, the innermost one wins.
+func annotate(src []byte, blocks []profileBlock, mode string, maxCount uint64) (template.HTML, error) {
+	lineStarts := []int{0}
+	for i, c := range src {
+		if c == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	offset := func(line, col int) (int, error) {
+		if line < 1 || line > len(lineStarts) {
+			return 0, fmt.Errorf("line %d out of range", line)
+		}
+		off := lineStarts[line-1] + col - 1
+		if off < 0 || off > len(src) {
+			return 0, fmt.Errorf("column %d of line %d out of range", col, line)
+		}
+		return off, nil
+	}
+
+	// 1 + the class of each byte, 0 for none.
+	class := make([]int, len(src))
+	type span struct{ start, end, class int }
+	var spans []span
+	for _, b := range blocks {
+		_, sl, sc, el, ec, err := parseBlockPos(b.pos)
+		if err != nil {
+			return "", err
+		}
+		start, err := offset(sl, sc)
+		if err != nil {
+			return "", err
+		}
+		end, err := offset(el, ec)
+		if err != nil {
+			return "", err
+		}
+		spans = append(spans, span{start, end, 1 + countClass(b.count, mode, maxCount)})
+	}
+	// widest first, so inner blocks are painted over outer ones.
+	slices.SortStableFunc(spans, func(a, b span) int {
+		return (b.end - b.start) - (a.end - a.start)
+	})
+	for _, s := range spans {
+		for i := s.start; i < s.end; i++ {
+			class[i] = s.class
+		}
+	}
+
+	var buf bytes.Buffer
+	for start := 0; start < len(src); {
+		end := start + 1
+		for end < len(src) && class[end] == class[start] {
+			end++
+		}
+		if class[start] != 0 {
+			fmt.Fprintf(&buf, `<span class="cov%d">`, class[start]-1)
+		}
+		template.HTMLEscape(&buf, src[start:end])
+		if class[start] != 0 {
+			buf.WriteString("</span>")
+		}
+		start = end
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// countClass returns the class of a block which ran count times: cov0 for
+// blocks which never ran, up to cov10 for those which ran most, like 'go tool
+// cover -html'.
+func countClass(count uint64, mode string, maxCount uint64) int {
+	switch {
+	case count == 0:
+		return 0
+	case mode == "set" || maxCount <= 1:
+		return 8
+	}
+	norm := math.Log(float64(count)) / math.Log(float64(maxCount))
+	return 1 + int(math.Floor(norm*9))
+}
+
+var htmlTemplate = template.Must(template.New("html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>coverage</title>
+<style>
+body { background: black; color: rgb(80, 80, 80); }
+body, pre, #legend span { font-family: Menlo, monospace; font-weight: bold; }
+#topbar { background: black; position: fixed; top: 0; left: 0; right: 0; height: 42px; border-bottom: 1px solid rgb(80, 80, 80); }
+#content { margin-top: 50px; }
+#nav, #legend { float: left; margin-left: 10px; }
+#legend { margin-top: 12px; }
+#nav { margin-top: 10px; }
+#legend span { margin: 0 5px; }
+.cov0 { color: rgb(192, 0, 0) }
+.cov1 { color: rgb(128, 128, 128) }
+.cov2 { color: rgb(116, 140, 131) }
+.cov3 { color: rgb(104, 152, 134) }
+.cov4 { color: rgb(92, 164, 137) }
+.cov5 { color: rgb(80, 176, 140) }
+.cov6 { color: rgb(68, 188, 143) }
+.cov7 { color: rgb(56, 200, 146) }
+.cov8 { color: rgb(44, 212, 149) }
+.cov9 { color: rgb(32, 224, 152) }
+.cov10 { color: rgb(20, 236, 155) }
+</style>
+</head>
+<body>
+<div id="topbar">
+<div id="nav">
+<select id="files">
+{{range $i, $f := .Files}}<option value="file{{$i}}">{{$f.Name}} ({{printf "%.1f" $f.Coverage}}%)</option>
+{{end}}</select>
+</div>
+<div id="legend">
+<span>not tracked</span>
+{{if .Set}}<span class="cov0">not covered</span>
+<span class="cov8">covered</span>
+{{else}}<span class="cov0">no coverage</span>
+<span class="cov1">low coverage</span>
+<span class="cov2">*</span>
+<span class="cov3">*</span>
+<span class="cov4">*</span>
+<span class="cov5">*</span>
+<span class="cov6">*</span>
+<span class="cov7">*</span>
+<span class="cov8">*</span>
+<span class="cov9">*</span>
+<span class="cov10">high coverage</span>
+{{end}}</div>
+</div>
+<div id="content">
+{{range $i, $f := .Files}}<pre class="file" id="file{{$i}}" style="display: none">{{$f.Body}}</pre>
+{{end}}</div>
+<script>
+(function() {
+	var files = document.getElementById('files');
+	var visible;
+	function show(id) {
+		var file = document.getElementById(id);
+		if (!file) {
+			return;
+		}
+		if (visible) {
+			visible.style.display = 'none';
+		}
+		file.style.display = 'block';
+		visible = file;
+		files.value = id;
+		window.scrollTo(0, 0);
+	}
+	files.addEventListener('change', function() {
+		location.hash = files.value;
+	}, false);
+	window.addEventListener('hashchange', function() {
+		show(location.hash.slice(1));
+	}, false);
+	show(location.hash.slice(1) || files.value);
+})();
+</script>
+</body>
+</html>
+`))
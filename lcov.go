@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// lcov converts a profile to LCOV tracefile format, for editors and other
+// tools which don't read Go's profiles.
+func lcov(args []string) int {
+	fs := flag.NewFlagSet("lcov", flag.ContinueOnError)
+	out := fs.String("o", "", "write the tracefile to `file` instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cover lcov [-o file] profile")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	p, err := readProfile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cached, err := cachedFiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = withOutput(*out, func(w io.Writer) error {
+		return writeLCOV(w, p, cached)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// writeLCOV writes a record for each file in the profile, with each line's
+// count from its innermost block. files are named by the path to their source,
+// where we know it.
+//
+// functions come from what we recorded when compiling: each is hit as many
+// times as the first block in it. that's only the function's own count when
+// the block starts before any code in the body does, which it always does with
+// block and func granularity. with statements, it could be the body of a
+// leading if or for instead, so those functions are left out.
+func writeLCOV(w io.Writer, p *profile, cached map[string]*cachedFile) error {
+	byFile := make(map[string][]lineBlock)
+	var names []string
+	for _, b := range p.blocks {
+		file, sl, sc, el, ec, err := parseBlockPos(b.pos)
+		if err != nil {
+			return err
+		}
+		if _, ok := byFile[file]; !ok {
+			names = append(names, file)
+		}
+		byFile[file] = append(byFile[file], lineBlock{sl, sc, el, ec, b.count})
+	}
+	slices.Sort(names)
+	counts, err := p.lineCounts()
+	if err != nil {
+		return err
+	}
+
+	buf := bufio.NewWriter(w)
+	for _, name := range names {
+		blocks := byFile[name]
+		cf := cached[name]
+		if cf == nil {
+			cf = new(cachedFile)
+		}
+
+		fmt.Fprintln(buf, "TN:")
+		sf := name
+		if cf.source != "" {
+			sf = cf.source
+		}
+		fmt.Fprintf(buf, "SF:%s\n", sf)
+
+		type fnCount struct {
+			fn    cachedFunc
+			count uint64
+		}
+		var fns []fnCount
+		for _, fn := range cf.funcs {
+			var first *lineBlock
+			for i, b := range blocks {
+				if !fn.contains(b.startLine, b.startCol, b.endLine, b.endCol) {
+					continue
+				}
+				if first == nil || b.startLine < first.startLine || (b.startLine == first.startLine && b.startCol < first.startCol) {
+					first = &blocks[i]
+				}
+			}
+			if first == nil || first.startLine > fn.bodyLine || (first.startLine == fn.bodyLine && first.startCol > fn.bodyCol) {
+				continue
+			}
+			fns = append(fns, fnCount{fn, first.count})
+		}
+		var fnHit int
+		for _, f := range fns {
+			fmt.Fprintf(buf, "FN:%d,%s\n", f.fn.startLine, f.fn.name)
+		}
+		for _, f := range fns {
+			if f.count > 0 {
+				fnHit++
+			}
+			fmt.Fprintf(buf, "FNDA:%d,%s\n", f.count, f.fn.name)
+		}
+		fmt.Fprintf(buf, "FNF:%d\n", len(fns))
+		fmt.Fprintf(buf, "FNH:%d\n", fnHit)
+
+		lines := counts[name]
+		nums := make([]int, 0, len(lines))
+		for l := range lines {
+			nums = append(nums, l)
+		}
+		slices.Sort(nums)
+		var hit int
+		for _, l := range nums {
+			fmt.Fprintf(buf, "DA:%d,%d\n", l, lines[l])
+			if lines[l] > 0 {
+				hit++
+			}
+		}
+		fmt.Fprintf(buf, "LF:%d\n", len(lines))
+		fmt.Fprintf(buf, "LH:%d\n", hit)
+		fmt.Fprintln(buf, "end_of_record")
+	}
+	return buf.Flush()
+}
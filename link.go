@@ -8,14 +8,17 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 )
 
 const (
 	coverImportcfg = "COVER_IMPORTCFG"
 	coverPkgPath   = "ehden.net/cover/vars"
+	apiPkgPath     = "ehden.net/cover/runtime"
 )
 
 // link generates the ehden.net/cover/vars package with all the cover vars, as
@@ -39,7 +42,7 @@ const (
 // anything about the original build command because the only packages we'll
 // use from our build are the ones which were not a part of the build to begin
 // with.
-func link(args []string) ([]string, error) {
+func link(conf config, args []string) ([]string, error) {
 	cfgIdx, cfgPath := getFlag(args, "importcfg")
 	cfg, err := readImportCfg(cfgPath)
 	if err != nil {
@@ -51,7 +54,8 @@ func link(args []string) ([]string, error) {
 		return args, err
 	}
 
-	mainArgs, err := genCoverVars(cfg, coverDir)
+	race := slices.Contains(args, "-race")
+	mainArgs, err := genCoverVars(conf, cfg, coverDir, race)
 	if err != nil {
 		return args, err
 	}
@@ -68,6 +72,14 @@ func link(args []string) ([]string, error) {
 		return args, err
 	}
 
+	// only the linker's packages which the vars package depends on are used
+	// to build it, and they make up part of the key its dependencies are
+	// cached by; see printVersion.
+	depsCfgPath, err := writeDepsImportCfg(coverDir, cfg, race)
+	if err != nil {
+		return args, err
+	}
+
 	list := exec.Command("go", "list",
 		// Needed for importcfg patching; see fixImportCfg.
 		"-toolexec", exe,
@@ -84,6 +96,11 @@ func link(args []string) ([]string, error) {
 		// ... for all packages in the build.
 		"-deps",
 	)
+	if race {
+		// The vars package must be built the same way as everything else
+		// for the race detector to see the counters.
+		list.Args = append(list.Args, "-race")
+	}
 	genCfg := new(importcfg)
 	list.Dir = coverDir
 	list.Stderr = os.Stderr
@@ -91,7 +108,7 @@ func link(args []string) ([]string, error) {
 	list.Env = append(list.Environ(),
 		// This lets us reference the linker's importcfg when compiling the vars
 		// package.
-		coverImportcfg+"="+cfgPath,
+		coverImportcfg+"="+depsCfgPath,
 		// Helpful in debugging; lets us preserve $WORK inside the existing
 		// work dir.
 		"GOTMPDIR="+filepath.Join(coverDir, "tmp"),
@@ -102,7 +119,7 @@ func link(args []string) ([]string, error) {
 	delete(genCfg.pkg, "unsafe") // fake
 
 	genExport := genCfg.pkg[coverPkgPath]
-	mainExport, err := rebuildMain(filepath.Dir(cfgPath), mainArgs, genExport)
+	mainExport, err := rebuildMain(filepath.Dir(cfgPath), mainArgs, genExport, cfg)
 	if err != nil {
 		return args, err
 	}
@@ -132,12 +149,48 @@ func link(args []string) ([]string, error) {
 	return args, nil
 }
 
+// writeDepsImportCfg writes the entries of the linker's importcfg for the
+// packages the vars package in dir depends on, and returns where it wrote them.
+func writeDepsImportCfg(dir string, linkCfg *importcfg, race bool) (string, error) {
+	list := exec.Command("go", "list", "-deps", "-f", "{{ .ImportPath }}")
+	if race {
+		list.Args = append(list.Args, "-race")
+	}
+	list.Dir = dir
+	list.Stderr = os.Stderr
+	out, err := list.Output()
+	if err != nil {
+		return "", err
+	}
+
+	cfg := &importcfg{pkg: make(map[string]string)}
+	for _, pkg := range strings.Fields(string(out)) {
+		if file, ok := linkCfg.pkg[pkg]; ok {
+			cfg.pkg[pkg] = file
+		}
+	}
+	path := filepath.Join(dir, "importcfg.deps")
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := cfg.WriteTo(f); err != nil {
+		return "", err
+	}
+	return path, f.Close()
+}
+
 const mainInitDotGo = `package main
 
 import _ "ehden.net/cover/vars"
 `
 
-func rebuildMain(workDir, args, covervars string) (string, error) {
+// rebuildMain compiles main again, the way it was compiled before, but
+// importing the cover vars. main may have been compiled by an earlier build,
+// whose $WORK, where some of its dependencies were, is gone by now, so they're
+// taken from wherever the linker, linkCfg, has them.
+func rebuildMain(workDir, args, covervars string, linkCfg *importcfg) (string, error) {
 	argv := strings.Split(args, " ")
 
 	oIdx, o := getFlag(argv, "o")
@@ -155,6 +208,11 @@ func rebuildMain(workDir, args, covervars string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	for pkg := range cfg.pkg {
+		if file, ok := linkCfg.pkg[pkg]; ok {
+			cfg.pkg[pkg] = file
+		}
+	}
 	cfg.pkg[coverPkgPath] = covervars
 	newCfgPath := filepath.Join(workDir, "importcfg.rebuild")
 	new, err := os.Create(newCfgPath)
@@ -178,39 +236,652 @@ func rebuildMain(workDir, args, covervars string) (string, error) {
 	return out, nil
 }
 
+// signals aren't much use, and SIGHUP isn't defined, under js.
+const signalDotGo = `//go:build !js
+
+package covervars
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	_ "unsafe" // for linkname
+)
+
+func init() {
+	if v := os.Getenv("COVER_SIGNALS"); v != "" {
+		if on, err := strconv.ParseBool(v); err != nil {
+			println("[ehden.net/cover] invalid COVER_SIGNALS:", strconv.Quote(v))
+		} else if on {
+			handleSignals()
+		}
+	}
+}
+
+// handleSignals writes a snapshot of coverage when the program is sent a
+// signal which would stop it. if the program doesn't handle the signal itself,
+// that would kill it without running any exit hooks, so the signal is raised
+// again to let it do just that. otherwise, it's left to the program, whose exit
+// writes coverage again as usual.
+func handleSignals() {
+	var sigs []os.Signal
+	for _, sig := range []os.Signal{syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP} {
+		// e.g. SIGHUP under nohup, which shouldn't stop the program now either.
+		if !signal.Ignored(sig) {
+			sigs = append(sigs, sig)
+		}
+	}
+	if len(sigs) == 0 {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		for sig := range c {
+			writeCoverage(outPath())
+			if handledElsewhere(sig) {
+				continue
+			}
+			signal.Stop(c)
+			p, err := os.FindProcess(os.Getpid())
+			if err == nil {
+				err = p.Signal(sig)
+			}
+			if err != nil {
+				// not every platform can send itself every signal.
+				os.Exit(1)
+			}
+			return
+		}
+	}()
+}
+
+// set by os/signal when the program uses it, to the number of channels a
+// signal is sent to, ours included.
+//
+//go:linkname signalRefs runtime.coverSignalRefs
+var signalRefs func(sig int) int64
+
+// handledElsewhere reports whether the program also asked for sig.
+func handledElsewhere(sig os.Signal) bool {
+	n, ok := sig.(syscall.Signal)
+	return ok && signalRefs != nil && signalRefs(int(n)) > 1
+}
+`
+
+// writes coverage data the way programs built with 'go build -cover' do, for
+// 'go tool covdata'. the meta-data file, covMeta, is generated along with the
+// cover vars; all that's left to do here is write the counters. see covdata.go
+// for the details of the format.
+const covdataDotGo = `package covervars
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the counters of a function in the meta-data, in the order of its units.
+type covFunc struct {
+	pkg, fn  uint32
+	counters []*uint32
+}
+
+// like outPath, the counter file's name only needs picking once, so that
+// flushing replaces it rather than adding more counts to what covdata reads.
+var covCountersName = sync.OnceValue(func() string {
+	return "covcounters." + hex.EncodeToString([]byte(covMetaHash)) +
+		"." + strconv.Itoa(os.Getpid()) +
+		"." + strconv.FormatInt(time.Now().UnixNano(), 10)
+})
+
+func writeCovData(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// programs built the same way share the meta-data.
+	meta := filepath.Join(dir, "covmeta."+hex.EncodeToString([]byte(covMetaHash)))
+	if info, err := os.Stat(meta); err != nil || info.Size() != int64(len(covMeta)) {
+		if err := writeFile(meta, func(w *bufio.Writer) { w.WriteString(covMeta) }); err != nil {
+			return err
+		}
+	}
+	return writeFile(filepath.Join(dir, covCountersName()), writeCovCounters)
+}
+
+func writeCovCounters(w *bufio.Writer) {
+	const magic = "\x00\x63\x77\x6d"
+	w.WriteString(magic)
+	w.Write(binary.LittleEndian.AppendUint32(nil, 1)) // version
+	w.WriteString(covMetaHash)
+	w.WriteByte(2) // counters are uleb128-encoded
+	w.WriteByte(0) // little-endian
+	w.Write(make([]byte, 6))
+
+	// a single segment, with the program's arguments, as the runtime records
+	// them, and the counters of every function which ran.
+	args := map[string]string{
+		"argc":   strconv.Itoa(len(os.Args)),
+		"GOOS":   runtime.GOOS,
+		"GOARCH": runtime.GOARCH,
+	}
+	for i, a := range os.Args {
+		args["argv"+strconv.Itoa(i)] = a
+	}
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	strs := []string{""}
+	index := map[string]int{"": 0}
+	lookup := func(s string) int {
+		i, ok := index[s]
+		if !ok {
+			i = len(strs)
+			index[s] = i
+			strs = append(strs, s)
+		}
+		return i
+	}
+	var argsData []byte
+	argsData = binary.AppendUvarint(argsData, uint64(len(keys)))
+	for _, k := range keys {
+		argsData = binary.AppendUvarint(argsData, uint64(lookup(k)))
+		argsData = binary.AppendUvarint(argsData, uint64(lookup(args[k])))
+	}
+	stab := binary.AppendUvarint(nil, uint64(len(strs)))
+	for _, s := range strs {
+		stab = binary.AppendUvarint(stab, uint64(len(s)))
+		stab = append(stab, s...)
+	}
+	// the counters start on a 4 byte boundary, counting from the segment
+	// header.
+	const segHeaderLen = 16
+	for (segHeaderLen+len(stab)+len(argsData))%4 != 0 {
+		argsData = append(argsData, 0)
+	}
+
+	var counters []byte
+	var entries uint64
+	for _, fn := range covFuncs {
+		live := false
+		for _, c := range fn.counters {
+			if atomic.LoadUint32(c) != 0 {
+				live = true
+				break
+			}
+		}
+		if !live {
+			continue
+		}
+		entries++
+		counters = binary.AppendUvarint(counters, uint64(len(fn.counters)))
+		counters = binary.AppendUvarint(counters, uint64(fn.pkg))
+		counters = binary.AppendUvarint(counters, uint64(fn.fn))
+		for _, c := range fn.counters {
+			counters = binary.AppendUvarint(counters, uint64(atomic.LoadUint32(c)))
+		}
+	}
+
+	w.Write(binary.LittleEndian.AppendUint64(nil, entries))
+	w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(stab))))
+	w.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(argsData))))
+	w.Write(stab)
+	w.Write(argsData)
+	w.Write(counters)
+
+	// footer
+	w.WriteString(magic)
+	w.Write(make([]byte, 4))
+	w.Write(binary.LittleEndian.AppendUint32(nil, 1)) // segments
+	w.Write(make([]byte, 4))
+}
+`
+
+// serves the profiles over HTTP, so they can be fetched from a running program,
+// and lets the counters be reset in between.
+const httpDotGo = `package covervars
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"os"
+)
+
+func init() {
+	// the address the program was built with can be changed, or unset, when
+	// running it.
+	addr := httpAddr
+	if v, ok := os.LookupEnv("` + coverHTTPAddrVar + `"); ok {
+		addr = v
+	}
+	if addr == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		println("[ehden.net/cover] could not serve coverage:", err.Error())
+		return
+	}
+	println("[ehden.net/cover] serving coverage on", ln.Addr().String())
+
+	// no method or wildcard patterns: whether they work depends on the go
+	// version of the program's module.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		serveProfile(writeBlocks)(w, r)
+	})
+	if branchProfile {
+		mux.HandleFunc("/branch", serveProfile(writeBranches))
+	}
+	if condProfile {
+		mux.HandleFunc("/cond", serveProfile(writeConds))
+	}
+	if funcProfile {
+		mux.HandleFunc("/func", serveProfile(writeFuncs))
+	}
+	mux.HandleFunc("/reset", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		reset()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	go http.Serve(ln, mux)
+}
+
+func serveProfile(write func(*bufio.Writer)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		write(bw)
+		bw.Flush()
+	}
+}
+`
+
 const writeDotGo = `package covervars
 
 import (
 	"bufio"
+	"io"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	_ "unsafe"
+)
+
+// a block of code, and how many times it ran.
+type block struct {
+	pos     string // file:startLine.startCol,endLine.endCol
+	numStmt int
+	count   *uint32
+}
+
+// a condition, and how many times it was false and true.
+type branch struct {
+	pos   string
+	count *[2]uint32
+}
+
+// an operand of && or || in a condition, and how many times it was false and
+// true. it decides the condition's value if nothing else is evaluated after it
+// is.
+type cond struct {
+	pos          string
+	count        *[2]uint32
+	decidesTrue  bool
+	decidesFalse bool
+}
+
+// a function, and how many times it was called.
+type function struct {
+	pos   string // file:line
+	name  string
+	count *uint32
+}
+
+// the runtime calls this whenever the program exits: returning from main,
+// calling os.Exit, or crashing with an unrecovered panic. fatal errors, such as
+// all goroutines being asleep, exit without calling it.
+//
+//go:linkname exitHook runtime.coverExitHook
+var exitHook func()
+
+// what ehden.net/cover/runtime calls to do what it says, when a program
+// imports it.
+var (
+	//go:linkname apiWriteTo ` + apiPkgPath + `.writeTo
+	apiWriteTo func(io.Writer) error
+	//go:linkname apiReset ` + apiPkgPath + `.reset
+	apiReset func()
+	//go:linkname apiEachBlock ` + apiPkgPath + `.eachBlock
+	apiEachBlock func(func(pos string, numStmt int, count uint32))
+	//go:linkname apiMode ` + apiPkgPath + `.mode
+	apiMode string
 )
 
-func runeFor(i uint8) rune {
-	if i == 1 {
-		return '1'
+func init() {
+	exitHook = onExit
+
+	apiWriteTo = func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		writeBlocks(bw)
+		return bw.Flush()
+	}
+	apiReset = reset
+	apiEachBlock = func(f func(string, int, uint32)) {
+		for _, b := range blocks {
+			f(b.pos, b.numStmt, atomic.LoadUint32(b.count))
+		}
+	}
+	apiMode = mode
+
+	if v := os.Getenv("COVER_FLUSH_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if n, nerr := strconv.Atoi(v); nerr == nil {
+			// plain numbers are seconds.
+			d, err = time.Duration(n)*time.Second, nil
+		}
+		if err != nil || d <= 0 {
+			println("[ehden.net/cover] invalid COVER_FLUSH_INTERVAL:", strconv.Quote(v))
+		} else {
+			go flush(d)
+		}
+	}
+}
+
+// flush rewrites the profiles every interval, so there's something to show
+// for the program even if it's killed without warning.
+func flush(interval time.Duration) {
+	for range time.Tick(interval) {
+		writeCoverage(outPath())
 	}
-	return '0'
 }
 
+// the goroutine running onExit, if any.
+var exiting atomic.Int64
+
+// onExit writes coverage as the program exits. writing it mustn't crash the
+// program, so a panic is only reported; nor wait on itself, should the runtime
+// call the hook again from the same goroutine. other goroutines exiting at the
+// same time wait for the profiles to be written, as usual.
+func onExit() {
+	g := goid()
+	if !exiting.CompareAndSwap(0, g) && exiting.Load() == g {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			msg := "panic"
+			switch r := r.(type) {
+			case error:
+				msg = r.Error()
+			case string:
+				msg = r
+			}
+			println("[ehden.net/cover] could not write coverage:", msg)
+		}
+	}()
+	WriteCoverage()
+}
+
+// goid returns the current goroutine's id, which the runtime only shows in
+// stack traces.
+func goid() int64 {
+	var buf [64]byte
+	s := strings.TrimPrefix(string(buf[:runtime.Stack(buf[:], false)]), "goroutine ")
+	id, _, _ := strings.Cut(s, " ")
+	n, _ := strconv.ParseInt(id, 10, 64)
+	return n
+}
+
+var written sync.Once
+
+// WriteCoverage writes the coverage profiles, once, however many ways the
+// program tries to exit.
 func WriteCoverage() {
-	outPath := "cover.out"
+	written.Do(func() {
+		path := outPath()
+		if dir := covDataDir(); dir != "" {
+			println("[ehden.net/cover] writing coverage data to", dir)
+		} else {
+			println("[ehden.net/cover] printing coverage profile to", path)
+		}
+		writeCoverage(path)
+	})
+}
+
+// outPath returns where this process writes its profile. with COVER_DIR set,
+// that's a file of its own in that directory, so that many processes can write
+// to it at once; the name only needs picking once.
+var outPath = sync.OnceValue(func() string {
+	if dir := os.Getenv("COVER_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			println("[ehden.net/cover] could not create COVER_DIR:", err.Error())
+		}
+		name := "cover." + strconv.Itoa(os.Getpid()) +
+			"." + strconv.FormatInt(time.Now().UnixNano(), 10) +
+			"." + strconv.FormatUint(uint64(rand.Uint32()), 36) + ".out"
+		return filepath.Join(dir, name)
+	}
 	if p := os.Getenv("COVER_PATH"); p != "" {
-		outPath = p
+		return p
+	}
+	return "cover.out"
+})
+
+// covDataDir returns where to write data for 'go tool covdata' instead of
+// profiles, if anywhere. GOCOVERDIR is often left set for 'go test -cover', so
+// it only counts with COVER_COVDATA set too.
+var covDataDir = sync.OnceValue(func() string {
+	v := os.Getenv("COVER_COVDATA")
+	if v == "" {
+		return ""
 	}
-	f, err := os.Create(outPath)
+	on, err := strconv.ParseBool(v)
 	if err != nil {
-		println("ehden.net/fizzbuzz: could not emit coverage data:", err)
+		println("[ehden.net/cover] invalid COVER_COVDATA:", strconv.Quote(v))
+		return ""
+	}
+	if !on {
+		return ""
+	}
+	dir := os.Getenv("GOCOVERDIR")
+	if dir == "" {
+		println("[ehden.net/cover] COVER_COVDATA is set, but GOCOVERDIR isn't")
+	}
+	return dir
+})
+
+var writing sync.Mutex
+
+// writeCoverage writes all the profiles we have, as many times as needed. with
+// COVER_COVDATA set, it writes the data for 'go tool covdata' to GOCOVERDIR
+// instead.
+func writeCoverage(outPath string) {
+	writing.Lock()
+	defer writing.Unlock()
+
+	if dir := covDataDir(); dir != "" {
+		if err := writeCovData(dir); err != nil {
+			println("[ehden.net/cover] could not emit coverage data:", err.Error())
+		}
+		return
+	}
+	if err := writeFile(outPath, writeBlocks); err != nil {
+		println("[ehden.net/cover] could not emit coverage data:", err.Error())
+	}
+	if branchProfile {
+		if err := writeFile(companionPath(outPath, "branch"), writeBranches); err != nil {
+			println("[ehden.net/cover] could not emit branch coverage data:", err.Error())
+		}
+	}
+	if condProfile {
+		if err := writeFile(companionPath(outPath, "cond"), writeConds); err != nil {
+			println("[ehden.net/cover] could not emit condition coverage data:", err.Error())
+		}
+	}
+	if funcProfile {
+		if err := writeFile(companionPath(outPath, "func"), writeFuncs); err != nil {
+			println("[ehden.net/cover] could not emit function coverage data:", err.Error())
+		}
+	}
+}
+
+// writeFile writes to a temporary file which then replaces the one at path, so
+// anyone reading it, or the program being killed, never sees it half-written.
+func writeFile(path string, write func(*bufio.Writer)) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	// temporary files are only readable by their owner, unlike what os.Create
+	// would've made.
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
 	}
-	defer f.Close()
-	println("[ehden.net/cover] printing coverage profile to", outPath)
 	w := bufio.NewWriter(f)
-	defer w.Flush()
-	w.WriteString("mode: set\n")
+	write(w)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func writeCount(w *bufio.Writer, c *uint32) {
+	w.WriteString(strconv.FormatUint(uint64(atomic.LoadUint32(c)), 10))
+}
+
+func writeBlocks(w *bufio.Writer) {
+	w.WriteString("mode: " + mode + "\n")
+	for _, b := range blocks {
+		w.WriteString(b.pos)
+		w.WriteByte(' ')
+		w.WriteString(strconv.Itoa(b.numStmt))
+		w.WriteByte(' ')
+		writeCount(w, b.count)
+		w.WriteByte('\n')
+	}
+}
+
+// branch profiles look like cover profiles, except that each line ends with
+// the number of times the condition was true, then false.
+func writeBranches(w *bufio.Writer) {
+	w.WriteString("mode: " + mode + "\n")
+	for _, b := range branches {
+		w.WriteString(b.pos)
+		w.WriteByte(' ')
+		writeCount(w, &b.count[1])
+		w.WriteByte(' ')
+		writeCount(w, &b.count[0])
+		w.WriteByte('\n')
+	}
+}
+
+// condition profiles are like branch profiles, with one more number at the end
+// of each line: how many times the operand decided the condition's value.
+func writeConds(w *bufio.Writer) {
+	w.WriteString("mode: " + mode + "\n")
+	for _, c := range conds {
+		w.WriteString(c.pos)
+		w.WriteByte(' ')
+		writeCount(w, &c.count[1])
+		w.WriteByte(' ')
+		writeCount(w, &c.count[0])
+		w.WriteByte(' ')
+		var decided uint32
+		if c.decidesTrue {
+			decided += atomic.LoadUint32(&c.count[1])
+		}
+		if c.decidesFalse {
+			decided += atomic.LoadUint32(&c.count[0])
+		}
+		writeCount(w, &decided)
+		w.WriteByte('\n')
+	}
+}
+
+// function reports list whether each function was called, and how many times,
+// followed by the share of them that were.
+func writeFuncs(w *bufio.Writer) {
+	var called int
+	for _, fn := range funcs {
+		w.WriteString(fn.pos + ":\t" + fn.name + "\t")
+		if atomic.LoadUint32(fn.count) > 0 {
+			called++
+			w.WriteString("called\t")
+		} else {
+			w.WriteString("uncalled\t")
+		}
+		writeCount(w, fn.count)
+		w.WriteByte('\n')
+	}
+	pct := 100.0
+	if len(funcs) > 0 {
+		pct = 100 * float64(called) / float64(len(funcs))
+	}
+	w.WriteString("total:\t" + strconv.Itoa(called) + "/" + strconv.Itoa(len(funcs)) + " called\t")
+	w.WriteString(strconv.FormatFloat(pct, 'f', 1, 64) + "%\n")
+}
+
+// reset zeroes every counter. counters being hit at the same time might not be,
+// unless they're atomic.
+func reset() {
+	// functions' counters are their blocks'.
+	for _, b := range blocks {
+		atomic.StoreUint32(b.count, 0)
+	}
+	for _, b := range branches {
+		atomic.StoreUint32(&b.count[0], 0)
+		atomic.StoreUint32(&b.count[1], 0)
+	}
+	for _, c := range conds {
+		atomic.StoreUint32(&c.count[0], 0)
+		atomic.StoreUint32(&c.count[1], 0)
+	}
+}
+
+// returns where a profile of the given kind goes, given the cover profile's
+// path, e.g. cover.out -> cover.branch.out.
+func companionPath(path, kind string) string {
+	ext := filepath.Ext(path)
+	return path[:len(path)-len(ext)] + "." + kind + ext
+}
 `
 
 // generates the covervars package. returns the compile command used to build
 // the main.
-func genCoverVars(cfg *importcfg, dir string) (string, error) {
+func genCoverVars(conf config, cfg *importcfg, dir string, race bool) (string, error) {
 	cacheDir, err := cacheDir()
 	if err != nil {
 		return "", fmt.Errorf("couldn't read cache dir: %w", err)
@@ -227,19 +898,62 @@ func genCoverVars(cfg *importcfg, dir string) (string, error) {
 	}
 	defer initfile.Close()
 
-	init := bufio.NewWriter(initfile)
-	init.WriteString(writeDotGo)
+	if _, err := initfile.WriteString(writeDotGo); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "signal.go"), []byte(signalDotGo), 0666); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "covdata.go"), []byte(covdataDotGo), 0666); err != nil {
+		return "", err
+	}
+	// only programs built to serve their coverage pay for net/http.
+	if conf.httpAddr != "" {
+		if err := os.WriteFile(filepath.Join(dir, "http.go"), []byte(httpDotGo), 0666); err != nil {
+			return "", err
+		}
+	}
+
+	mode := conf.mode
+	// like 'go build -cover', only atomic counters are allowed alongside the
+	// race detector, and they're what we use unless asked otherwise.
+	if race && os.Getenv(coverModeVar) == "" {
+		mode = "atomic"
+	} else if race && mode != "atomic" {
+		return "", fmt.Errorf("%s must be \"atomic\", not %q, when -race is enabled", coverModeVar, mode)
+	}
+	// what each cover func does to its counter when the block is hit.
+	hit := map[string]string{
+		"set":    "%s = 1",
+		"count":  "%s++",
+		"atomic": "atomic.AddUint32(&%s, 1)",
+	}[mode]
 
 	vars := bufio.NewWriter(varfile)
 	vars.WriteString("package covervars\n\n")
-	vars.WriteString("import _ \"unsafe\"\n\n")
+	vars.WriteString("import _ \"unsafe\"\n")
+	if mode == "atomic" {
+		vars.WriteString("import \"sync/atomic\"\n")
+	}
+	fmt.Fprintf(vars, "\nconst mode = %q\n", mode)
+	fmt.Fprintf(vars, "const branchProfile = %t\n", conf.branch)
+	fmt.Fprintf(vars, "const condProfile = %t\n", conf.conditions)
+	fmt.Fprintf(vars, "const funcProfile = %t\n", conf.granularity == "func")
+	fmt.Fprintf(vars, "const httpAddr = %q\n\n", conf.httpAddr)
 
-	pkgs := coverPkgs()
+	// tables of everything we're counting, written after all the cover vars.
+	blocks := bytes.NewBufferString("var blocks = []block{\n")
+	branches := bytes.NewBufferString("var branches = []branch{\n")
+	conds := bytes.NewBufferString("var conds = []cond{\n")
+	funcs := bytes.NewBufferString("var funcs = []function{\n")
+
+	pkgs := conf.pkgs
 	if slices.Contains(pkgs, "*") {
 		pkgs = make([]string, 0, len(cfg.pkg))
 		for p := range cfg.pkg {
 			pkgs = append(pkgs, p)
 		}
+		slices.Sort(pkgs)
 	} else if len(pkgs) == 0 {
 		for pkg := range cfg.pkg {
 			if pkg == cfg.firstPkg {
@@ -249,6 +963,9 @@ func genCoverVars(cfg *importcfg, dir string) (string, error) {
 		}
 	}
 
+	// the same blocks, grouped by package and function, for covdata.
+	var covPkgs []*covPkg
+
 	var main string
 	for _, pkg := range pkgs {
 		file, ok := cfg.pkg[pkg]
@@ -256,6 +973,17 @@ func genCoverVars(cfg *importcfg, dir string) (string, error) {
 			continue
 		}
 
+		name := path.Base(pkg)
+		if pkg == cfg.firstPkg {
+			name = "main"
+		}
+		cp := &covPkg{path: pkg, name: name}
+		type fileUnit struct {
+			file string
+			unit covUnit
+		}
+		var units []fileUnit
+
 		var errs []error
 		if err := eachCacheLine(cacheDir, file, func(id, line string, last bool) {
 			if last {
@@ -266,30 +994,123 @@ func genCoverVars(cfg *importcfg, dir string) (string, error) {
 				return
 			}
 
-			block, suffix, found := strings.Cut(line, " ")
-			if !found {
+			fields := strings.Fields(line)
+			if len(fields) < 3 {
 				errs = append(errs, fmt.Errorf("invalid cache line for %s: %q", pkg, line))
+				return
+			}
+			block, numStmt, suffix := fields[0], fields[1], fields[2]
+			kind := plainBlock
+			if len(fields) > 3 {
+				kind = fields[3]
 			}
 
-			fmt.Fprintf(init, "\tw.WriteString(%q)\n", block+" 1 ")
-			fmt.Fprintf(init, "\tw.WriteRune(runeFor(_cover_%s_%s))\n", suffix, cleanIDPart(id))
-			fmt.Fprintf(init, "\tw.WriteRune('\\n')\n")
-
-			cv := fmt.Sprintf("cover_%s_%s", suffix, cleanIDPart(id))
-			fmt.Fprintf(vars, "var _%s uint8\n", cv)
-			fmt.Fprintf(vars, "//go:linkname %s %s.%s\n", cv, coverPkgPath, cv)
-			fmt.Fprintf(vars, "func %s() { _%s = 1 } // %s\n\n", cv, cv, block)
+			cv := fmt.Sprintf("%s_%s_%s", coverVarPrefix(kind), suffix, cleanIDPart(id))
+			switch kind {
+			case declExtent, litExtent:
+				file, sl, sc, el, ec, err := parseBlockPos(block)
+				if err != nil || len(fields) != 6 {
+					errs = append(errs, fmt.Errorf("invalid cache line for %s: %q", pkg, line))
+					return
+				}
+				cp.extents = append(cp.extents, covExtent{
+					file:      file,
+					startLine: sl, startCol: sc, endLine: el, endCol: ec,
+					fn: &covFunc{name: fields[4], file: file, lit: kind == litExtent},
+				})
+			case plainBlock, funcBlock:
+				fmt.Fprintf(vars, "var _%s uint32\n", cv)
+				fmt.Fprintf(vars, "//go:linkname %s %s.%s\n", cv, coverPkgPath, cv)
+				fmt.Fprintf(vars, "func %s() { %s } // %s\n\n", cv, fmt.Sprintf(hit, "_"+cv), block)
+				fmt.Fprintf(blocks, "\t{%q, %s, &_%s},\n", block, numStmt, cv)
+				file, sl, sc, el, ec, err := parseBlockPos(block)
+				n, nerr := strconv.Atoi(numStmt)
+				if err != nil || nerr != nil {
+					errs = append(errs, fmt.Errorf("invalid cache line for %s: %q", pkg, line))
+					return
+				}
+				units = append(units, fileUnit{file, covUnit{
+					stLine: uint32(sl), stCol: uint32(sc), enLine: uint32(el), enCol: uint32(ec),
+					numStmt: uint32(n),
+					counter: "_" + cv,
+				}})
+				if kind == plainBlock {
+					break
+				}
+				if len(fields) != 5 {
+					errs = append(errs, fmt.Errorf("invalid cache line for %s: %q", pkg, line))
+					return
+				}
+				// file:startLine.startCol,... -> file:startLine
+				file, pos, _ := strings.Cut(block, ":")
+				startLine, _, _ := strings.Cut(pos, ".")
+				fmt.Fprintf(funcs, "\t{%q, %q, &_%s},\n", file+":"+startLine, fields[4], cv)
+			case branchBlock, condBlock:
+				fmt.Fprintf(vars, "var _%s [2]uint32\n", cv)
+				fmt.Fprintf(vars, "//go:linkname %s %s.%s\n", cv, coverPkgPath, cv)
+				fmt.Fprintf(vars, "func %s(b bool) bool { // %s\n", cv, block)
+				fmt.Fprintf(vars, "\tif b {\n\t\t%s\n\t} else {\n\t\t%s\n\t}\n", fmt.Sprintf(hit, "_"+cv+"[1]"), fmt.Sprintf(hit, "_"+cv+"[0]"))
+				fmt.Fprintf(vars, "\treturn b\n}\n\n")
+				if kind == branchBlock {
+					fmt.Fprintf(branches, "\t{%q, &_%s},\n", block, cv)
+					break
+				}
+				if len(fields) != 5 || len(fields[4]) != 2 {
+					errs = append(errs, fmt.Errorf("invalid cache line for %s: %q", pkg, line))
+					return
+				}
+				decides := fields[4]
+				fmt.Fprintf(conds, "\t{%q, &_%s, %t, %t},\n", block, cv, decides[0] == 't', decides[1] == 'f')
+			case sourceExtent:
+				// only needed for reports.
+			default:
+				errs = append(errs, fmt.Errorf("invalid cache line for %s: unknown kind %q", pkg, kind))
+			}
 		}); err != nil {
 			return "", fmt.Errorf("cache read error for %q: %w", pkg, err)
 		}
 		if len(errs) > 0 {
 			return "", fmt.Errorf("cache read error for %q: %w", pkg, errors.Join(errs...))
 		}
+
+		for _, u := range units {
+			cp.addUnit(u.file, u.unit)
+		}
+		cp.finish()
+		if len(cp.funcs) > 0 {
+			covPkgs = append(covPkgs, cp)
+		}
 	}
 
-	init.WriteString("}")
-	vars.Flush()
-	init.Flush()
+	meta, hash := encodeCovMeta(covPkgs, mode)
+	fmt.Fprintf(vars, "const covMeta = %q\n\n", meta)
+	fmt.Fprintf(vars, "const covMetaHash = %q\n\n", hash[:])
+	fmt.Fprintf(vars, "var covFuncs = []covFunc{\n")
+	for i, p := range covPkgs {
+		for j, fn := range p.funcs {
+			fmt.Fprintf(vars, "\t{%d, %d, []*uint32{", i, j)
+			for k, u := range fn.units {
+				if k > 0 {
+					vars.WriteString(", ")
+				}
+				vars.WriteString("&" + u.counter)
+			}
+			vars.WriteString("}},\n")
+		}
+	}
+	vars.WriteString("}\n\n")
+
+	blocks.WriteString("}\n\n")
+	branches.WriteString("}\n\n")
+	conds.WriteString("}\n\n")
+	funcs.WriteString("}\n")
+	vars.Write(blocks.Bytes())
+	vars.Write(branches.Bytes())
+	vars.Write(conds.Bytes())
+	vars.Write(funcs.Bytes())
+	if err := vars.Flush(); err != nil {
+		return "", err
+	}
 
 	// probably means main was not selected for coverage instrumentation, so we
 	// need to search for it in importcfg.link ourselves.
@@ -351,7 +1172,8 @@ func (cfg *importcfg) Write(line []byte) (n int, err error) {
 	n = len(line)
 	key, val, found := bytes.Cut(line, []byte(" "))
 	if !bytes.Equal(key, []byte("packagefile")) || !found {
-		cfg.other = append(cfg.other, line)
+		// line may be reused by whoever's writing, e.g. a bufio.Scanner.
+		cfg.other = append(cfg.other, bytes.Clone(line))
 		return
 	}
 
@@ -422,7 +1244,7 @@ func (cfg *importcfg) WriteTo(w io.Writer) (int64, error) {
 }
 
 func eachCacheLine(cacheDir, export string, fn func(id, line string, last bool)) error {
-	id, err := buildid(export)
+	id, err := archiveBuildID(export)
 	if err != nil {
 		return err
 	}
@@ -3,15 +3,77 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"debug/elf"
 	"encoding/base64"
 	"fmt"
+	"hash"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
 )
 
-const coverPathsVar = "COVER_PATHS"
+const (
+	coverPathsVar       = "COVER_PATHS"
+	coverModeVar        = "COVER_MODE"
+	coverGranularityVar = "COVER_GRANULARITY"
+	coverBranchVar      = "COVER_BRANCH"
+	coverConditionsVar  = "COVER_CONDITIONS"
+	coverHTTPAddrVar    = "COVER_HTTP_ADDR"
+)
+
+// config holds the settings, read from the environment, which change what we
+// generate when compiling and linking.
+type config struct {
+	pkgs        []string // see coverPkgs
+	mode        string   // see coverMode
+	granularity string   // see coverGranularity
+	branch      bool     // count conditions each time they're true or false
+	conditions  bool     // count the operands of && and || in conditions too
+	httpAddr    string   // where programs serve their coverage by default, if at all
+}
+
+func readConfig() (config, error) {
+	mode, err := coverMode()
+	if err != nil {
+		return config{}, err
+	}
+	granularity, err := coverGranularity()
+	if err != nil {
+		return config{}, err
+	}
+	branch, err := boolVar(coverBranchVar)
+	if err != nil {
+		return config{}, err
+	}
+	conditions, err := boolVar(coverConditionsVar)
+	if err != nil {
+		return config{}, err
+	}
+	// func granularity has a counter per function, and none for branches or
+	// conditions.
+	if granularity == "func" {
+		if branch {
+			return config{}, fmt.Errorf("%s can't be used with %s=func", coverBranchVar, coverGranularityVar)
+		}
+		if conditions {
+			return config{}, fmt.Errorf("%s can't be used with %s=func", coverConditionsVar, coverGranularityVar)
+		}
+	}
+	return config{
+		pkgs:        coverPkgs(),
+		mode:        mode,
+		granularity: granularity,
+		branch:      branch,
+		conditions:  conditions,
+		httpAddr:    strings.TrimSpace(os.Getenv(coverHTTPAddrVar)),
+	}, nil
+}
 
 func main() {
 	os.Exit(main1())
@@ -23,7 +85,91 @@ func (e errJustExit) Error() string {
 	return "exit: " + fmt.Sprint(int(e))
 }
 
+// the commands for working with profiles, run as 'cover <command>', rather
+// than by the go command.
+type command struct {
+	name  string
+	args  string // what follows the name in its usage
+	short string
+	run   func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	// set here, since help refers to them all.
+	commands = []command{
+		{"merge", "[-o file] [profile | dir]...", "combine coverage profiles", merge},
+		{"html", "[-o file] profile", "write an HTML report of a coverage profile", htmlReport},
+		{"lcov", "[-o file] profile", "convert a coverage profile to LCOV", lcov},
+		{"cobertura", "[-o file] profile", "convert a coverage profile to Cobertura XML", cobertura},
+		{"check", "-config file profile", "check coverage against thresholds", check},
+		{"diff", "[-diff file] profile", "report coverage of the lines changed by a patch", diff},
+		{"compare", "old-profile new-profile", "report how coverage changed between two profiles", compare},
+		{"version", "", "print the version of cover", version},
+		{"help", "[command]", "show help for cover or a command", help},
+	}
+}
+
+const usage = `cover instruments whole programs for coverage, as a wrapper around the
+compiler and linker:
+
+	go build -toolexec cover [build flags] [packages]
+
+It also has commands for working with the profiles those programs write:
+
+	cover <command> [arguments]
+
+The commands are:
+
+`
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, usage)
+	var width int
+	for _, c := range commands {
+		width = max(width, len(c.name))
+	}
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t%-*s  %s\n", width, c.name, c.short)
+	}
+	fmt.Fprintln(w, "\nUse \"cover help <command>\" for more about a command.")
+}
+
+func lookupCommand(name string) (command, bool) {
+	for _, c := range commands {
+		if c.name == name {
+			return c, true
+		}
+	}
+	return command{}, false
+}
+
+// isTool reports whether arg is the path of a tool to run. the go command always
+// runs us with the absolute path of the compiler, linker and the like, but the
+// path of any tool can be given when running us by hand.
+func isTool(arg string) bool {
+	return filepath.IsAbs(arg) || strings.ContainsRune(arg, '/') || strings.ContainsRune(arg, filepath.Separator)
+}
+
 func main1() int {
+	if len(os.Args) < 2 {
+		printUsage(os.Stderr)
+		return 2
+	}
+	name := os.Args[1]
+	switch name {
+	case "-h", "-help", "--help":
+		name = "help"
+	}
+	if c, ok := lookupCommand(name); ok {
+		return c.run(os.Args[2:])
+	}
+	if !isTool(os.Args[1]) {
+		fmt.Fprintf(os.Stderr, "cover: unknown command %q\nRun 'cover help' for usage.\n", os.Args[1])
+		return 2
+	}
+
 	tool, args := os.Args[1], os.Args[2:]
 
 	args, err := toolexec(tool, args...)
@@ -35,21 +181,79 @@ func main1() int {
 		return 1
 	}
 
+	run := runTool
+	if filepath.Base(tool) == "compile" {
+		run = compileCached
+	}
+	if err := run(tool, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	return 0
+}
+
+func runTool(tool string, args []string) error {
 	cmd := exec.Command(tool, args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return 1
+	return cmd.Run()
+}
+
+// withOutput calls fn with the file at path, or stdout if path is empty, for
+// commands which take -o. the file isn't written until it's closed, so that's
+// checked too.
+func withOutput(path string, fn func(io.Writer) error) error {
+	if path == "" {
+		return fn(os.Stdout)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func help(args []string) int {
+	switch len(args) {
+	case 0:
+		printUsage(os.Stdout)
+		return 0
+	case 1:
+	default:
+		fmt.Fprintln(os.Stderr, "usage: cover help [command]")
+		return 2
+	}
+	c, ok := lookupCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "cover help %s: unknown command\nRun 'cover help' for usage.\n", args[0])
+		return 2
 	}
+	fmt.Printf("usage: cover %s %s\n\n%s.\n", c.name, c.args, strings.ToUpper(c.short[:1])+c.short[1:])
+	return 0
+}
 
+func version(args []string) int {
+	if len(args) != 0 {
+		fmt.Fprintln(os.Stderr, "usage: cover version")
+		return 2
+	}
+	v := "(devel)"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		v = info.Main.Version
+	}
+	fmt.Printf("cover %s %s\n", v, runtime.Version())
 	return 0
 }
 
 // printVersion prints the version of the underlying tool to stdout, along with
-// a hash combining our own tool version (buildID) and the sorted list of
-// packages we're configured to instrument.
-func printVersion(tool string, coverPaths []string, args ...string) error {
+// a hash combining our own tool version (buildID) and our config, including the
+// sorted list of packages we're configured to instrument.
+func printVersion(tool string, conf config, args ...string) error {
 	cmd := exec.Command(tool, args...)
 	stdout := bytes.NewBuffer(nil)
 	cmd.Stdout = stdout
@@ -65,25 +269,73 @@ func printVersion(tool string, coverPaths []string, args ...string) error {
 	if err != nil {
 		return err
 	}
-	h.Write([]byte(id))
-	sum := h.Sum([]byte(strings.Join(coverPaths, "")))
-	b := base64.RawURLEncoding.EncodeToString(sum)
+	hashFields(h,
+		id,
+		conf.granularity,
+		strconv.FormatBool(conf.branch),
+		strconv.FormatBool(conf.conditions),
+	)
+	// the mode and address are only built into the cover vars package, so
+	// changing them needn't recompile everything else.
+	if filepath.Base(tool) == "link" {
+		hashFields(h, conf.mode, conf.httpAddr)
+	}
+	hashFields(h, strconv.Itoa(len(conf.pkgs)))
+	hashFields(h, conf.pkgs...)
+	// while building the cover vars package, its dependencies are compiled
+	// against the linker's packages (see fixImportCfg), so they mustn't be
+	// cached alongside ones compiled against different packages. link only
+	// passes us those the vars package depends on, so that other programs
+	// using the same ones can share them.
+	if linkPath := os.Getenv(coverImportcfg); linkPath != "" {
+		cfg, err := readImportCfg(linkPath)
+		if err != nil {
+			return err
+		}
+		var pkgs []string
+		for pkg := range cfg.pkg {
+			pkgs = append(pkgs, pkg)
+		}
+		slices.Sort(pkgs)
+		for _, pkg := range pkgs {
+			id, err := archiveBuildID(cfg.pkg[pkg])
+			if err != nil {
+				return err
+			}
+			// the content half of the ID, since the same package can be
+			// compiled the same way for different actions.
+			_, content, _ := strings.Cut(id, "/")
+			hashFields(h, pkg, content)
+		}
+	}
+	b := base64.RawURLEncoding.EncodeToString(h.Sum(nil))
 	if _, err := fmt.Fprintf(os.Stdout, "%s +cover %s\n", v, b); err != nil {
 		return err
 	}
 	return nil
 }
 
+// hashFields writes each field to h prefixed with its length, so that
+// different fields can't run together into the same hash.
+func hashFields(h hash.Hash, fields ...string) {
+	for _, f := range fields {
+		fmt.Fprintf(h, "%d:%s", len(f), f)
+	}
+}
+
 func toolexec(tool string, args ...string) ([]string, error) {
 	toolName := filepath.Base(tool)
 	if toolName != "compile" && toolName != "link" {
 		return args, nil
 	}
 
-	pkgs := coverPkgs()
+	conf, err := readConfig()
+	if err != nil {
+		return args, err
+	}
 
 	if len(args) > 0 && args[0] == "-V=full" {
-		if err := printVersion(tool, pkgs, args...); err != nil {
+		if err := printVersion(tool, conf, args...); err != nil {
 			return args, err
 		}
 		return args, errJustExit(0)
@@ -91,9 +343,9 @@ func toolexec(tool string, args ...string) ([]string, error) {
 
 	switch toolName {
 	case "compile":
-		return compile(pkgs, tool, args)
+		return compile(conf, tool, args)
 	case "link":
-		return link(args)
+		return link(conf, args)
 	}
 
 	return args, nil
@@ -112,7 +364,7 @@ func myBuildID() (string, error) {
 		os.Exit(1)
 	}
 
-	buildID, err = buildid(exe)
+	buildID, err = exeBuildID(exe)
 	if err != nil {
 		return "", err
 	}
@@ -130,6 +382,53 @@ func buildid(path string) (string, error) {
 	return strings.TrimSpace(buf.String()), nil
 }
 
+// exeBuildID returns the build ID of an executable. we need our own for every
+// compile, so on ELF systems it's read from the note the linker leaves it in,
+// rather than by running 'go tool buildid'.
+func exeBuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return buildid(path)
+	}
+	defer f.Close()
+	if sect := f.Section(".note.go.buildid"); sect != nil {
+		note, err := sect.Data()
+		if err != nil {
+			return "", err
+		}
+		// namesz, descsz and type, then the name "Go\x00\x00" and the ID.
+		if len(note) >= 16 && string(note[12:16]) == "Go\x00\x00" {
+			n := f.ByteOrder.Uint32(note[4:])
+			if desc := note[16:]; int(n) <= len(desc) {
+				return string(desc[:n]), nil
+			}
+		}
+	}
+	return buildid(path)
+}
+
+// archiveBuildID returns the build ID of a compiled package. the compiler puts
+// it at the top of the archive, so it's read from there rather than by running
+// 'go tool buildid' for every package.
+func archiveBuildID(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, 4<<10)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, id, ok := bytes.Cut(buf[:n], []byte("\nbuild id \"")); ok {
+		if id, _, ok := bytes.Cut(id, []byte(`"`)); ok {
+			return string(id), nil
+		}
+	}
+	return buildid(path)
+}
+
 func cacheDir() (string, error) {
 	dir, err := os.UserCacheDir()
 	if err != nil {
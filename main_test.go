@@ -19,13 +19,29 @@ func TestMain(m *testing.M) {
 var update = flag.Bool("u", false, "update testscript files")
 
 func TestScript(t *testing.T) {
+	// the scripts share a build cache, and ours alongside it in HOME, so each
+	// configuration only builds the standard library, and patches the runtime,
+	// once for all of them. that's safe since both caches are keyed by what
+	// went into each build, not by package paths: the go command's by the
+	// contents of sources and our tool ID, which has the configuration in it,
+	// and ours by action IDs and compiler inputs. the one exception is reports,
+	// which find files in our cache by their names in profiles, so scripts
+	// which write them use modules of their own.
+	shared := t.TempDir()
 	p := testscript.Params{
 		Dir:           "testdata",
 		TestWork:      true,
 		UpdateScripts: *update,
 		Cmds:          map[string]func(ts *testscript.TestScript, neg bool, args []string){},
 		Setup: func(env *testscript.Env) error {
-			env.Setenv("HOME", filepath.Join(env.WorkDir, "home"))
+			env.Setenv("HOME", filepath.Join(shared, "home"))
+			env.Setenv("GOCACHE", filepath.Join(shared, "go-cache"))
+			// for scripts which need this module's packages.
+			wd, err := os.Getwd()
+			if err != nil {
+				return err
+			}
+			env.Setenv("MODROOT", wd)
 			return nil
 		},
 	}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// merge combines the profiles of many runs of a program, such as those written
+// with COVER_DIR, into one.
+func merge(args []string) int {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	out := fs.String("o", "", "write the merged profile to `file` instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: cover merge [-o file] [profile | dir]...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	paths, err := profilePaths(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	merged, err := mergeProfiles(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = withOutput(*out, func(w io.Writer) error {
+		_, err := merged.WriteTo(w)
+		return err
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *out == "" {
+		return 0
+	}
+	if err := mergeCompanions(paths, merged.mode, *out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// mergeProfiles adds up the counts of each block across profiles, or in set
+// mode, marks the ones which ran in any. the profiles must agree on which
+// blocks each file has, or they can't have come from the same sources.
+func mergeProfiles(paths []string) (*profile, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no profiles to merge")
+	}
+	var merged *profile
+	index := make(map[string]int) // pos -> index in merged.blocks
+	files := make(map[string]fileBlocks)
+	for _, path := range paths {
+		p, err := readProfile(path)
+		if err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged = &profile{mode: p.mode}
+		} else if p.mode != merged.mode {
+			return nil, fmt.Errorf("%s: mode %q doesn't match %q", path, p.mode, merged.mode)
+		}
+		for file, fb := range p.fileBlocks() {
+			seen, ok := files[file]
+			if !ok {
+				files[file] = fb
+				continue
+			}
+			if !slices.Equal(seen.blocks, fb.blocks) {
+				return nil, fmt.Errorf("%s: blocks of %s don't match those in %s", path, file, seen.profile)
+			}
+		}
+		for _, b := range p.blocks {
+			i, ok := index[b.pos]
+			if !ok {
+				index[b.pos] = len(merged.blocks)
+				merged.blocks = append(merged.blocks, b)
+				continue
+			}
+			if merged.mode == "set" {
+				merged.blocks[i].count = max(merged.blocks[i].count, b.count)
+			} else {
+				merged.blocks[i].count += b.count
+			}
+		}
+	}
+	return merged, nil
+}
+
+// the blocks a profile has for a file, ignoring their counts.
+type fileBlocks struct {
+	profile string // the first profile they were seen in
+	blocks  []string
+}
+
+func (p *profile) fileBlocks() map[string]fileBlocks {
+	files := make(map[string]fileBlocks)
+	for _, b := range p.blocks {
+		file := b.pos
+		if i := strings.LastIndexByte(b.pos, ':'); i >= 0 {
+			file = b.pos[:i]
+		}
+		fb := files[file]
+		fb.profile = p.path
+		fb.blocks = append(fb.blocks, fmt.Sprintf("%s %d", b.pos, b.numStmt))
+		files[file] = fb
+	}
+	for _, fb := range files {
+		slices.Sort(fb.blocks)
+	}
+	return files
+}
+
+// a line of a branch, condition or function profile: what it counts, and the
+// counts.
+type companionLine struct {
+	key    string // the position, and for functions, the name
+	counts []uint64
+}
+
+// mergeCompanions merges the branch, condition and function profiles next to
+// paths, where there are any, writing each next to out.
+func mergeCompanions(paths []string, mode, out string) error {
+	for _, kind := range companionKinds {
+		var merged []companionLine
+		index := make(map[string]int) // key -> index in merged
+		for _, path := range paths {
+			lines, err := readCompanion(companionPath(path, kind), kind)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			for _, l := range lines {
+				i, ok := index[l.key]
+				if !ok {
+					index[l.key] = len(merged)
+					merged = append(merged, l)
+					continue
+				}
+				if len(l.counts) != len(merged[i].counts) {
+					return fmt.Errorf("%s: counts of %s don't match those in other profiles", companionPath(path, kind), l.key)
+				}
+				for j, n := range l.counts {
+					if mode == "set" {
+						merged[i].counts[j] = max(merged[i].counts[j], n)
+					} else {
+						merged[i].counts[j] += n
+					}
+				}
+			}
+		}
+		if merged == nil {
+			continue
+		}
+		if err := writeCompanion(companionPath(out, kind), kind, mode, merged); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readCompanion reads a profile of the given kind. branch and condition
+// profiles have a mode line, then each position and its counts; function
+// profiles have a tab-separated line for each function, and a total.
+func readCompanion(path, kind string) ([]companionLine, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []companionLine
+	for n, line := range strings.Split(string(data), "\n") {
+		if line == "" || (kind != "func" && n == 0) || strings.HasPrefix(line, "total:") {
+			continue
+		}
+		var key string
+		var counts []string
+		if kind == "func" {
+			// pos:, name, called or uncalled, count
+			fields := strings.Split(line, "\t")
+			if len(fields) != 4 {
+				return nil, fmt.Errorf("%s:%d: invalid function: %q", path, n+1, line)
+			}
+			key, counts = fields[0]+"\t"+fields[1], fields[3:]
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: invalid %s: %q", path, n+1, kind, line)
+			}
+			key, counts = fields[0], fields[1:]
+		}
+		l := companionLine{key: key}
+		for _, c := range counts {
+			count, err := strconv.ParseUint(c, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid count %q", path, n+1, c)
+			}
+			l.counts = append(l.counts, count)
+		}
+		lines = append(lines, l)
+	}
+	return lines, nil
+}
+
+// writeCompanion writes lines the way the cover vars package does.
+func writeCompanion(path, kind, mode string, lines []companionLine) error {
+	var b strings.Builder
+	if kind != "func" {
+		fmt.Fprintf(&b, "mode: %s\n", mode)
+		for _, l := range lines {
+			b.WriteString(l.key)
+			for _, c := range l.counts {
+				fmt.Fprintf(&b, " %d", c)
+			}
+			b.WriteByte('\n')
+		}
+		return os.WriteFile(path, []byte(b.String()), 0666)
+	}
+	var called int
+	for _, l := range lines {
+		state := "uncalled"
+		if l.counts[0] > 0 {
+			called++
+			state = "called"
+		}
+		fmt.Fprintf(&b, "%s\t%s\t%d\n", l.key, state, l.counts[0])
+	}
+	pct := 100.0
+	if len(lines) > 0 {
+		pct = 100 * float64(called) / float64(len(lines))
+	}
+	fmt.Fprintf(&b, "total:\t%d/%d called\t%.1f%%\n", called, len(lines), pct)
+	return os.WriteFile(path, []byte(b.String()), 0666)
+}
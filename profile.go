@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// a coverage profile, as written by the cover vars package or 'go test
+// -coverprofile'.
+type profile struct {
+	path   string // where it was read from, if anywhere
+	mode   string
+	blocks []profileBlock
+}
+
+type profileBlock struct {
+	pos     string // importPath/file.go:startLine.startCol,endLine.endCol
+	numStmt int
+	count   uint64
+}
+
+func readProfile(path string) (*profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	p, err := parseProfile(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	p.path = path
+	return p, nil
+}
+
+func parseProfile(r io.Reader) (*profile, error) {
+	p := new(profile)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if n == 1 {
+			mode, ok := strings.CutPrefix(line, "mode: ")
+			if !ok {
+				return nil, fmt.Errorf("line 1: missing mode line")
+			}
+			p.mode = mode
+			continue
+		}
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: invalid block: %q", n, line)
+		}
+		numStmt, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid statement count: %w", n, err)
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid count: %w", n, err)
+		}
+		p.blocks = append(p.blocks, profileBlock{pos: fields[0], numStmt: numStmt, count: count})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if p.mode == "" {
+		return nil, fmt.Errorf("empty profile")
+	}
+	p.combineDuplicates()
+	return p, nil
+}
+
+// combineDuplicates combines blocks which appear more than once, as in the
+// profiles 'go test -coverprofile' writes for many packages at once, where each
+// test binary covering a package adds its blocks again. like 'go tool cover',
+// their counts are added up, or in set mode, marked if any ran.
+func (p *profile) combineDuplicates() {
+	index := make(map[string]int) // pos -> index in blocks
+	blocks := p.blocks[:0]
+	for _, b := range p.blocks {
+		i, ok := index[b.pos]
+		if !ok {
+			index[b.pos] = len(blocks)
+			blocks = append(blocks, b)
+			continue
+		}
+		if p.mode == "set" {
+			blocks[i].count = max(blocks[i].count, b.count)
+		} else {
+			blocks[i].count += b.count
+		}
+	}
+	p.blocks = blocks
+}
+
+func (p *profile) WriteTo(w io.Writer) (int64, error) {
+	buf := bufio.NewWriter(w)
+	var N int64
+	n, err := fmt.Fprintf(buf, "mode: %s\n", p.mode)
+	N += int64(n)
+	if err != nil {
+		return N, err
+	}
+	for _, b := range p.blocks {
+		n, err := fmt.Fprintf(buf, "%s %d %d\n", b.pos, b.numStmt, b.count)
+		N += int64(n)
+		if err != nil {
+			return N, err
+		}
+	}
+	return N, buf.Flush()
+}
+
+// the kinds of profile written alongside the main one, e.g. cover.branch.out
+// alongside cover.out.
+var companionKinds = []string{"branch", "cond", "func"}
+
+// returns where a profile of the given kind goes, given the cover profile's
+// path, e.g. cover.out -> cover.branch.out. like in the cover vars package.
+func companionPath(path, kind string) string {
+	ext := filepath.Ext(path)
+	return path[:len(path)-len(ext)] + "." + kind + ext
+}
+
+// reports whether path is a companion to some other profile, going by its name.
+func isCompanion(path string) bool {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for _, kind := range companionKinds {
+		if strings.HasSuffix(name, "."+kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// profilePaths expands directories among paths into the profiles inside them,
+// e.g. those written with COVER_DIR.
+func profilePaths(paths []string) ([]string, error) {
+	var all []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			all = append(all, path)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(path, "*.out"))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if !isCompanion(m) {
+				all = append(all, m)
+			}
+		}
+	}
+	return all, nil
+}
+
+// parseBlockPos splits a block's position, as found in profiles and cache
+// entries, into its file and the line and column it starts and ends at.
+func parseBlockPos(pos string) (file string, startLine, startCol, endLine, endCol int, err error) {
+	i := strings.LastIndexByte(pos, ':')
+	if i < 0 {
+		return "", 0, 0, 0, 0, fmt.Errorf("invalid block position %q", pos)
+	}
+	file = pos[:i]
+	if _, err := fmt.Sscanf(pos[i+1:], "%d.%d,%d.%d", &startLine, &startCol, &endLine, &endCol); err != nil {
+		return "", 0, 0, 0, 0, fmt.Errorf("invalid block position %q", pos)
+	}
+	return file, startLine, startCol, endLine, endCol, nil
+}
+
+// a block, by the lines it covers.
+type lineBlock struct {
+	startLine, startCol, endLine, endCol int
+	count                                uint64
+}
+
+// reports whether b contains o, and isn't the same block.
+func (b lineBlock) contains(o lineBlock) bool {
+	startsBefore := b.startLine < o.startLine || (b.startLine == o.startLine && b.startCol <= o.startCol)
+	endsAfter := b.endLine > o.endLine || (b.endLine == o.endLine && b.endCol >= o.endCol)
+	return startsBefore && endsAfter && b != o
+}
+
+// lineCounts returns how many times each line with code on it ran, by file.
+// blocks can contain others, like a statement containing a function literal,
+// so a line ran as often as the innermost block on it did; where blocks on a
+// line don't nest, it's the most any of them ran.
+func (p *profile) lineCounts() (map[string]map[int]uint64, error) {
+	byFile := make(map[string][]lineBlock)
+	for _, b := range p.blocks {
+		file, sl, sc, el, ec, err := parseBlockPos(b.pos)
+		if err != nil {
+			return nil, err
+		}
+		byFile[file] = append(byFile[file], lineBlock{sl, sc, el, ec, b.count})
+	}
+	counts := make(map[string]map[int]uint64, len(byFile))
+	for file, blocks := range byFile {
+		onLine := make(map[int][]lineBlock)
+		for _, b := range blocks {
+			for l := b.startLine; l <= b.endLine; l++ {
+				onLine[l] = append(onLine[l], b)
+			}
+		}
+		lines := make(map[int]uint64, len(onLine))
+		for l, bs := range onLine {
+			var count uint64
+			for _, b := range bs {
+				if !slices.ContainsFunc(bs, b.contains) {
+					count = max(count, b.count)
+				}
+			}
+			lines[l] = count
+		}
+		counts[file] = lines
+	}
+	return counts, nil
+}
@@ -0,0 +1,73 @@
+// Package runtime lets programs built with 'go build -toolexec cover' control
+// their own coverage while they run: write the profile out, look at the
+// counters, or reset them between phases of a test.
+//
+// Programs built without cover have no coverage to control, so each function
+// here does nothing.
+package runtime
+
+import (
+	"io"
+	_ "unsafe" // for linkname
+)
+
+// these are set by the cover vars package, which only exists in programs built
+// with cover.
+var (
+	//go:linkname writeTo
+	writeTo func(io.Writer) error
+	//go:linkname reset
+	reset func()
+	//go:linkname eachBlock
+	eachBlock func(func(pos string, numStmt int, count uint32))
+	//go:linkname mode
+	mode string
+)
+
+// A Block is a block of code, and how many times it ran so far.
+type Block struct {
+	Pos     string // file:startLine.startCol,endLine.endCol, as in profiles
+	NumStmt int
+	Count   uint32
+}
+
+// Enabled reports whether the program was built with cover.
+func Enabled() bool {
+	return writeTo != nil
+}
+
+// Mode returns the coverage mode the program was built with (set, count or
+// atomic), or "" if it wasn't built with cover.
+func Mode() string {
+	return mode
+}
+
+// WriteTo writes the coverage profile as it is so far to w, in the same format
+// as the one written when the program exits.
+func WriteTo(w io.Writer) error {
+	if writeTo == nil {
+		return nil
+	}
+	return writeTo(w)
+}
+
+// Reset zeroes every counter. Unless the program was built in atomic mode,
+// blocks which are running at the same time might not be reset.
+func Reset() {
+	if reset != nil {
+		reset()
+	}
+}
+
+// Snapshot returns every block of code being counted, and how many times it
+// has run so far.
+func Snapshot() []Block {
+	if eachBlock == nil {
+		return nil
+	}
+	var blocks []Block
+	eachBlock(func(pos string, numStmt int, count uint32) {
+		blocks = append(blocks, Block{Pos: pos, NumStmt: numStmt, Count: count})
+	})
+	return blocks
+}